@@ -0,0 +1,135 @@
+package aoe
+
+import (
+	"io"
+	"unsafe"
+)
+
+// ataAlignment returns the alignment, in bytes, of I/O performed on the
+// store of Target t: the physical sector size reported by its Identity, or
+// the AoE sector size if t is nil or has no Identity.
+func ataAlignment(t *Target) int64 {
+	if t == nil || t.Identity == nil {
+		return sectorSize
+	}
+
+	_, physical := t.Identity.sectorSizes()
+	return int64(physical)
+}
+
+// alignedBuffer allocates a zeroed buffer of n bytes whose address is a
+// multiple of align, as required for I/O on files opened with O_DIRECT.
+func alignedBuffer(n int, align int64) []byte {
+	b := make([]byte, n+int(align))
+	skip := int(align-int64(uintptr(unsafe.Pointer(&b[0])))%align) % int(align)
+
+	return b[skip : skip+n : skip+n]
+}
+
+// isAligned reports whether the address of p and the range of n bytes
+// beginning at offset off are all multiples of align.
+func isAligned(p []byte, off int64, align int64) bool {
+	if len(p) == 0 {
+		return true
+	}
+
+	return int64(uintptr(unsafe.Pointer(&p[0])))%align == 0 &&
+		off%align == 0 && int64(len(p))%align == 0
+}
+
+// alignRange expands the n bytes beginning at off to the smallest range
+// whose start and length are multiples of align.
+func alignRange(off int64, n int, align int64) (start int64, length int) {
+	start = off - off%align
+
+	end := off + int64(n)
+	if rem := end % align; rem != 0 {
+		end += align - rem
+	}
+
+	return start, int(end - start)
+}
+
+// readAlignedAt reads exactly len(p) bytes from the store at offset off, in
+// the same manner as readFullAt, but performs I/O on the store using an
+// aligned buffer and range, as described by alignedBuffer and alignRange.
+func (s *ataStore) readAlignedAt(p []byte, off int64, align int64) (int, error) {
+	if isAligned(p, off, align) {
+		return s.readFullAt(p, off)
+	}
+
+	start, n := alignRange(off, len(p), align)
+	b := alignedBuffer(n, align)
+
+	// The store may end partway through its final physical sector, so only
+	// the bytes actually requested must be read
+	nn, err := s.readFullAt(b, start)
+	need := int(off-start) + len(p)
+	if nn < need {
+		if err == nil {
+			err = io.EOF
+		}
+
+		if nn < int(off-start) {
+			return 0, err
+		}
+
+		return copy(p, b[off-start:nn]), err
+	}
+
+	return copy(p, b[off-start:need]), nil
+}
+
+// alignWrite prepares p to be written to the store at offset off, using an
+// aligned buffer and range, as described by alignedBuffer and alignRange.
+// If p does not cover entire physical sectors, the remainder of the first
+// and last physical sectors is read from the store, so that it is written
+// back unchanged.  Any part of those sectors beyond the end of the store is
+// filled with zeros.
+//
+// alignWrite returns the data to write and its offset.  done must be called
+// once the data has been written, so that concurrent writes to the same
+// physical sector cannot be lost.  Writes are serialized using the lock
+// kept by Target t, if t is not nil, or by the store otherwise.
+func (s *ataStore) alignWrite(p []byte, off int64, t *Target) (b []byte, start int64, done func(), err error) {
+	align := ataAlignment(t)
+
+	rmw := &s.rmw
+	if t != nil {
+		rmw = &t.rmw
+	}
+
+	if isAligned(p, off, align) {
+		rmw.RLock()
+		return p, off, rmw.RUnlock, nil
+	}
+
+	start, n := alignRange(off, len(p), align)
+	b = alignedBuffer(n, align)
+
+	// Only writes which are already aligned in the store, but not in memory,
+	// can be prepared without reading from the store
+	if start == off && n == len(p) {
+		copy(b, p)
+
+		rmw.RLock()
+		return b, start, rmw.RUnlock, nil
+	}
+
+	rmw.Lock()
+
+	// Read the first and last physical sectors, which may be the same
+	if s.ra != nil {
+		last := start + int64(n) - align
+		for _, o := range []int64{start, last} {
+			_, err := s.readFullAt(b[o-start:o-start+align], o)
+			if err != nil && err != io.EOF {
+				rmw.Unlock()
+				return nil, 0, nil, err
+			}
+		}
+	}
+
+	copy(b[off-start:], p)
+	return b, start, rmw.Unlock, nil
+}
@@ -0,0 +1,285 @@
+package aoe
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func Test_alignRange(t *testing.T) {
+	var tests = []struct {
+		desc   string
+		off    int64
+		n      int
+		align  int64
+		start  int64
+		length int
+	}{
+		{
+			desc:   "aligned",
+			off:    4096,
+			n:      8192,
+			align:  4096,
+			start:  4096,
+			length: 8192,
+		},
+		{
+			desc:   "unaligned start",
+			off:    4608,
+			n:      3584,
+			align:  4096,
+			start:  4096,
+			length: 4096,
+		},
+		{
+			desc:   "unaligned end",
+			off:    4096,
+			n:      512,
+			align:  4096,
+			start:  4096,
+			length: 4096,
+		},
+		{
+			desc:   "spans physical sectors",
+			off:    3584,
+			n:      1024,
+			align:  4096,
+			start:  0,
+			length: 8192,
+		},
+		{
+			desc:   "AoE sectors",
+			off:    1024,
+			n:      512,
+			align:  sectorSize,
+			start:  1024,
+			length: 512,
+		},
+	}
+
+	for i, tt := range tests {
+		start, length := alignRange(tt.off, tt.n, tt.align)
+		if want, got := tt.start, start; want != got {
+			t.Fatalf("[%02d] test %q, unexpected start: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.length, length; want != got {
+			t.Fatalf("[%02d] test %q, unexpected length: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_alignedBuffer(t *testing.T) {
+	for _, align := range []int64{512, 4096} {
+		for _, n := range []int{512, 4096, 65536} {
+			b := alignedBuffer(n, align)
+			if want, got := n, len(b); want != got {
+				t.Fatalf("unexpected buffer length: %v != %v", want, got)
+			}
+			if uintptr(unsafe.Pointer(&b[0]))%uintptr(align) != 0 {
+				t.Fatalf("buffer of %d bytes not aligned to %d bytes", n, align)
+			}
+		}
+	}
+}
+
+func TestServeATAPhysicalSectorAlignment(t *testing.T) {
+	const physical = 4096
+
+	ds := &directStore{
+		align: physical,
+		b:     bytes.Repeat([]byte{0xff}, physical*4),
+	}
+
+	target := &Target{
+		Major:    1,
+		Minor:    1,
+		Store:    ds,
+		Identity: &Identity{PhysicalSectorSize: physical},
+	}
+
+	serve := func(arg *ATAArg) *ATAArg {
+		w := &captureHeaderResponseSender{}
+		r := &Request{
+			Header: &Header{
+				Command: CommandIssueATACommand,
+				Arg:     arg,
+			},
+			Target: target,
+		}
+
+		if _, err := serveATA(w, r, target.ataStore()); err != nil {
+			t.Fatalf("failed to serve ATA request: %v", err)
+		}
+
+		return w.h.Arg.(*ATAArg)
+	}
+
+	// Write two AoE sectors which straddle the first and second physical
+	// sectors, and verify them
+	data := bytes.Repeat([]byte{0xaa}, sectorSize*2)
+	arg := serve(&ATAArg{
+		FlagWrite:   true,
+		CmdStatus:   ATACmdStatusWriteVerify,
+		LBA:         [6]uint8{7},
+		SectorCount: 2,
+		Data:        data,
+	})
+	if want, got := ATACmdStatusReadyStatus, arg.CmdStatus; want != got {
+		t.Fatalf("unexpected write status: %#02x != %#02x (error: %#02x)",
+			want, got, arg.ErrFeature)
+	}
+
+	// Only the written sectors were modified
+	want := bytes.Repeat([]byte{0xff}, physical*4)
+	copy(want[7*sectorSize:], data)
+	if got := ds.bytes(); !bytes.Equal(want, got) {
+		t.Fatal("unexpected store contents after unaligned write")
+	}
+
+	// Read the same sectors, along with their neighbors
+	arg = serve(&ATAArg{
+		CmdStatus:   ATACmdStatusRead28Bit,
+		LBA:         [6]uint8{6},
+		SectorCount: 4,
+	})
+	if want, got := ATACmdStatusReadyStatus, arg.CmdStatus; want != got {
+		t.Fatalf("unexpected read status: %#02x != %#02x (error: %#02x)",
+			want, got, arg.ErrFeature)
+	}
+	if want, got := want[6*sectorSize:10*sectorSize], arg.Data; !bytes.Equal(want, got) {
+		t.Fatal("unexpected data from unaligned read")
+	}
+}
+
+func TestServeATAAtConcurrentPartialPhysicalSectorWrites(t *testing.T) {
+	const (
+		physical = 4096
+		n        = physical / sectorSize
+	)
+
+	// Slow writes widen the window in which unserialized writes to the same
+	// physical sector would overwrite each other
+	ds := &directStore{
+		align:      physical,
+		b:          make([]byte, physical),
+		writeDelay: 10 * time.Millisecond,
+	}
+
+	target := &Target{
+		Major:    1,
+		Minor:    1,
+		Identity: &Identity{PhysicalSectorSize: physical},
+	}
+
+	// Each write covers a distinct AoE sector within the same physical
+	// sector, and is served by a separate call to ServeATAAt
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	argC := make(chan *ATAArg, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+
+			w := &captureHeaderResponseSender{}
+			_, _ = ServeATAAt(w, &Request{
+				Header: &Header{
+					Command: CommandIssueATACommand,
+					Arg: &ATAArg{
+						FlagWrite:   true,
+						CmdStatus:   ATACmdStatusWrite28Bit,
+						LBA:         [6]uint8{uint8(i)},
+						SectorCount: 1,
+						Data:        bytes.Repeat([]byte{uint8(i + 1)}, sectorSize),
+					},
+				},
+				Target: target,
+			}, ds)
+
+			argC <- w.h.Arg.(*ATAArg)
+		}(i)
+	}
+
+	wg.Wait()
+	close(argC)
+
+	for arg := range argC {
+		if want, got := ATACmdStatusReadyStatus, arg.CmdStatus; want != got {
+			t.Fatalf("unexpected write status: %#02x != %#02x (error: %#02x)",
+				want, got, arg.ErrFeature)
+		}
+	}
+
+	// No write may be lost to a concurrent read-modify-write
+	want := make([]byte, physical)
+	for i := 0; i < n; i++ {
+		copy(want[i*sectorSize:], bytes.Repeat([]byte{uint8(i + 1)}, sectorSize))
+	}
+	if got := ds.bytes(); !bytes.Equal(want, got) {
+		t.Fatal("concurrent partial physical sector writes were lost")
+	}
+}
+
+// errUnaligned is returned by directStore for unaligned I/O.
+var errUnaligned = errors.New("unaligned I/O")
+
+// directStore is an in-memory io.ReadSeeker, io.ReaderAt, and io.WriterAt
+// which, like a file opened with O_DIRECT, rejects I/O whose offset, length,
+// or buffer address is not a multiple of its align field.
+type directStore struct {
+	noopReadWriteSeeker
+	align      int64
+	writeDelay time.Duration
+
+	mu sync.Mutex
+	b  []byte
+}
+
+func (s *directStore) ReadAt(p []byte, off int64) (int, error) {
+	if !s.aligned(p, off) {
+		return 0, errUnaligned
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copy(p, s.b[off:]), nil
+}
+
+func (s *directStore) WriteAt(p []byte, off int64) (int, error) {
+	if !s.aligned(p, off) {
+		return 0, errUnaligned
+	}
+
+	time.Sleep(s.writeDelay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copy(s.b[off:], p), nil
+}
+
+func (s *directStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return int64(len(s.b))
+}
+
+func (s *directStore) aligned(p []byte, off int64) bool {
+	return uintptr(unsafe.Pointer(&p[0]))%uintptr(s.align) == 0 &&
+		off%s.align == 0 && int64(len(p))%s.align == 0
+}
+
+// bytes returns a copy of the contents of s.
+func (s *directStore) bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyBytes(s.b)
+}
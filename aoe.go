@@ -33,6 +33,25 @@ type ResponseSender interface {
 	Send(*Header) (int, error)
 }
 
+// A Handler responds to an AoE request.
+//
+// ServeAoE should send a reply Header using the ResponseSender, and then
+// return.  Handlers may choose not to reply to a request, as is required by
+// some Commands.
+type Handler interface {
+	ServeAoE(w ResponseSender, r *Request)
+}
+
+// HandlerFunc is an adapter which allows the use of an ordinary function as
+// an AoE handler.  If f is a function with the appropriate signature,
+// HandlerFunc(f) is a Handler which calls f.
+type HandlerFunc func(w ResponseSender, r *Request)
+
+// ServeAoE calls f(w, r).
+func (f HandlerFunc) ServeAoE(w ResponseSender, r *Request) {
+	f(w, r)
+}
+
 // An Arg is an argument for a Command.  Different Arg implementations are
 // used for different types of Commands.
 type Arg interface {
@@ -1,10 +1,10 @@
 package aoe
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
-	"os"
 )
 
 // An ATACmdStatus is a value which indicates an ATA command or status.
@@ -14,16 +14,31 @@ const (
 	// ATAErrAbort indicates than an ATA command should be aborted.
 	ATAErrAbort = 0x04
 
+	// ATAErrIDNotFound indicates that an ATA command addressed sectors
+	// outside the capacity of a device.
+	ATAErrIDNotFound = 0x10
+
+	// ATAErrUncorrectable indicates that an ATA command failed due to a
+	// media error in the backing store.
+	ATAErrUncorrectable = 0x40
+
 	// ATACmdStatus values recognized by ServeATA.
-	ATACmdStatusErrStatus   ATACmdStatus = 0x01
-	ATACmdStatusReadyStatus ATACmdStatus = 0x40
-	ATACmdStatusCheckPower  ATACmdStatus = 0xe5
-	ATACmdStatusFlush       ATACmdStatus = 0xe7
-	ATACmdStatusIdentify    ATACmdStatus = 0xec
-	ATACmdStatusRead28Bit   ATACmdStatus = 0x20
-	ATACmdStatusRead48Bit   ATACmdStatus = 0x24
-	ATACmdStatusWrite28Bit  ATACmdStatus = 0x30
-	ATACmdStatusWrite48Bit  ATACmdStatus = 0x34
+	ATACmdStatusErrStatus         ATACmdStatus = 0x01
+	ATACmdStatusReadyStatus       ATACmdStatus = 0x40
+	ATACmdStatusCheckPower        ATACmdStatus = 0xe5
+	ATACmdStatusFlush             ATACmdStatus = 0xe7
+	ATACmdStatusFlushExt          ATACmdStatus = 0xea
+	ATACmdStatusIdentify          ATACmdStatus = 0xec
+	ATACmdStatusRead28Bit         ATACmdStatus = 0x20
+	ATACmdStatusRead48Bit         ATACmdStatus = 0x24
+	ATACmdStatusWrite28Bit        ATACmdStatus = 0x30
+	ATACmdStatusWrite48Bit        ATACmdStatus = 0x34
+	ATACmdStatusWriteVerify       ATACmdStatus = 0x3c
+	ATACmdStatusReadVerify28Bit   ATACmdStatus = 0x40
+	ATACmdStatusReadVerify48Bit   ATACmdStatus = 0x42
+	ATACmdStatusSMART             ATACmdStatus = 0xb0
+	ATACmdStatusDataSetManagement ATACmdStatus = 0x06
+	ATACmdStatusSetFeatures       ATACmdStatus = 0xef
 
 	// sectorSize is the required AoE sector size, as specified in AoEr11,
 	// Section 3.
@@ -39,6 +54,47 @@ var (
 	ErrNotImplemented = errors.New("not implemented")
 )
 
+// ATAHandler returns a Handler which serves AoE ATA requests using ServeATA,
+// performing ATA operations on rs.
+//
+// Errors returned by ServeATA are not reported to the client, and the request
+// is dropped.  Clients are expected to retransmit requests which receive no
+// reply.
+func ATAHandler(rs io.ReadSeeker) Handler {
+	return ataHandler(newATAStore(rs))
+}
+
+// ATAHandlerAt returns a Handler which serves AoE ATA requests using
+// ServeATAAt, performing ATA operations on ra.
+//
+// Errors are handled in the same way as ATAHandler.
+func ATAHandlerAt(ra io.ReaderAt) Handler {
+	return ataHandler(newATAStore(ra))
+}
+
+// ataHandler returns a Handler which serves AoE ATA requests using s.  s is
+// shared by all requests, so that stores which must be adapted for use with
+// ReadAt and WriteAt are used safely.
+func ataHandler(s *ataStore) Handler {
+	return HandlerFunc(func(w ResponseSender, r *Request) {
+		_, _ = serveATA(w, r, s)
+	})
+}
+
+// serveTargetATA serves AoE ATA requests using the Store of the Target
+// associated with r.  If no Store is available, ErrorDeviceUnavailable is
+// returned to the client.
+func serveTargetATA(w ResponseSender, r *Request) {
+	if r.Target == nil || r.Target.Store == nil {
+		_, _ = w.Send(&Header{
+			Error: ErrorDeviceUnavailable,
+		})
+		return
+	}
+
+	_, _ = serveATA(w, r, r.Target.ataStore())
+}
+
 // ServeATA replies to an AoE ATA request after performing the requested
 // ATA operations on the io.ReadSeeker.  ServeATA can handle a variety of
 // ATA requests, including reads, writes, and identification.
@@ -54,12 +110,48 @@ var (
 // ErrInvalidATARequest is returned.
 //
 // If ATA identification is requested, but rs does not implement Identifier,
-// ErrNotImplemented is returned.  This behavior will change in the future,
-// and Identifier implementations will be optional.
+// identification data is generated using the size of rs, and the Identity
+// of r.Target, if r.Target is set.
 //
 // If an ATA write is requested, but rs does not implement io.Writer, the ATA
 // request will be aborted, but no error will be returned by ServeATA.
-func ServeATA(w ResponseSender, r *Header, rs io.ReadSeeker) (int, error) {
+//
+// ATA reads must address sectors within the capacity of the device, or the
+// request fails with ATAErrIDNotFound.  If r.Target specifies a fixed Size,
+// it is used as the capacity, and ATA writes are checked as well.
+// Otherwise, the size of rs is used, and writes beyond the end of rs grow
+// it.  If rs returns an error, the request fails with ATAErrUncorrectable.
+//
+// The command value 0x40 is handled as READ VERIFY SECTORS.
+//
+// If r.Target is set, clients may enable and disable its volatile write
+// cache and read look-ahead using ATA SET FEATURES.
+//
+// If rs implements io.ReaderAt and io.WriterAt, such as *os.File, ServeATA
+// may be called concurrently with the same rs, as long as each call uses the
+// same r.Target.  Otherwise, concurrent calls must be serialized by the
+// caller.  Handlers returned by ATAHandler, and Targets served by a Server,
+// serialize operations automatically.
+func ServeATA(w ResponseSender, r *Request, rs io.ReadSeeker) (int, error) {
+	return serveATA(w, r, newATAStore(rs))
+}
+
+// ServeATAAt is like ServeATA, but performs ATA operations on ra using its
+// ReadAt method.  ATA writes are performed using ra's WriteAt method, and
+// are aborted if ra does not implement io.WriterAt.  ServeATAAt may be
+// called concurrently with the same ra, so that multiple outstanding
+// requests can be serviced in parallel.
+//
+// The capacity of ra is determined using its Size or Stat method, if it has
+// one, or by seeking to its end if it implements io.Seeker.  If the capacity
+// cannot be determined, reads fail with an error, unless r.Target specifies
+// a fixed Size.
+func ServeATAAt(w ResponseSender, r *Request, ra io.ReaderAt) (int, error) {
+	return serveATA(w, r, newATAStore(ra))
+}
+
+// serveATA implements ServeATA and ServeATAAt, using store s.
+func serveATA(w ResponseSender, r *Request, s *ataStore) (int, error) {
 	// Ensure request intends to issue an ATA command
 	if r.Command != CommandIssueATACommand {
 		return 0, ErrInvalidATARequest
@@ -69,69 +161,121 @@ func ServeATA(w ResponseSender, r *Header, rs io.ReadSeeker) (int, error) {
 		return 0, ErrInvalidATARequest
 	}
 
-	// Request to check device power mode or flush device writes
-	// TODO(mdlayher): determine if these need to be different cases, because
-	// they are no-op operations here
-	if arg.CmdStatus == ATACmdStatusCheckPower || arg.CmdStatus == ATACmdStatusFlush {
-		return w.Send(&Header{
-			Arg: &ATAArg{
-				// Device is active or idle
-				SectorCount: 0xff,
-				// Device is ready
-				CmdStatus: ATACmdStatusReadyStatus,
-			},
-		})
-	}
-
-	// Handle other request types
+	// Handle request types
 	var warg *ATAArg
 	var err error
 
 	switch arg.CmdStatus {
+	// Request to check device power mode
+	case ATACmdStatusCheckPower:
+		warg = &ATAArg{
+			// Device is active or idle
+			SectorCount: 0xff,
+			// Device is ready
+			CmdStatus: ATACmdStatusReadyStatus,
+		}
+	// Request to flush device writes
+	case ATACmdStatusFlush, ATACmdStatusFlushExt:
+		warg, err = ataFlush(arg, s)
 	// Request to identify ATA device
 	case ATACmdStatusIdentify:
-		warg, err = ataIdentify(arg, rs)
+		warg, err = ataIdentify(arg, s, r.Target)
 	// Request for ATA read
 	case ATACmdStatusRead28Bit, ATACmdStatusRead48Bit:
-		warg, err = ataRead(arg, rs)
+		warg, err = ataRead(arg, s, r.Target)
 	// Request for ATA write
-	case ATACmdStatusWrite28Bit, ATACmdStatusWrite48Bit:
-		warg, err = ataWrite(arg, rs)
-	// ATA device is ready
-	case ATACmdStatusReadyStatus:
-		return 0, nil
+	case ATACmdStatusWrite28Bit, ATACmdStatusWrite48Bit, ATACmdStatusWriteVerify:
+		warg, err = ataWrite(arg, s, r.Target)
+	// Request to verify that sectors can be read
+	case ATACmdStatusReadVerify28Bit, ATACmdStatusReadVerify48Bit:
+		warg, err = ataReadVerify(arg, s, r.Target)
+	// Request for ATA SMART data or status
+	case ATACmdStatusSMART:
+		warg, err = ataSMART(arg, s, r.Target)
+	// Request to trim unused sectors
+	case ATACmdStatusDataSetManagement:
+		warg, err = ataDataSetManagement(arg, s, r.Target)
+	// Request to enable or disable device features
+	case ATACmdStatusSetFeatures:
+		warg, err = ataSetFeatures(arg, r.Target)
 	// Unknown ATA command, abort
 	default:
-		// TODO(mdlayher): possibly expose SMART data when a *block.Device
-		// is passed for rs
 		err = errATAAbort
 	}
 
-	// Return non-abort errors
-	if err != nil && err != errATAAbort {
-		return 0, err
-	}
-
-	// If aborted, an ATAArg is returned stating that the command
-	// was aborted
-	if err == errATAAbort {
+	// If aborted, out of range, or failed due to a media error, an ATAArg
+	// is returned stating why the command failed.  Other errors are
+	// returned.
+	switch err {
+	case nil:
+	case errATAAbort:
 		warg = &ATAArg{
 			CmdStatus:  ATACmdStatusErrStatus,
 			ErrFeature: ATAErrAbort,
 		}
+	case errATAIDNotFound:
+		warg = &ATAArg{
+			CmdStatus:  ATACmdStatusErrStatus,
+			ErrFeature: ATAErrIDNotFound,
+		}
+	case errATAUncorrectable:
+		warg = &ATAArg{
+			CmdStatus:  ATACmdStatusErrStatus,
+			ErrFeature: ATAErrUncorrectable,
+		}
+	default:
+		return 0, err
 	}
 
-	// Reply to client; w handles Header field copying
+	// Reply to client; w fills in the remaining Header fields using the
+	// request
 	return w.Send(&Header{
 		Arg: warg,
 	})
 }
 
-// errATAAbort is returned when an ATA command is aborted due to incorrect
-// request parameters.  It is a sentinel value used to indicate that a
-// special abort response should be sent to a client, but it is not returned
-// by ServeATA.
-var errATAAbort = errors.New("ATA command aborted")
+var (
+	// errATAAbort is returned when an ATA command is aborted due to
+	// incorrect request parameters.  It is a sentinel value used to indicate
+	// that a special abort response should be sent to a client, but it is
+	// not returned by ServeATA.
+	errATAAbort = errors.New("ATA command aborted")
+
+	// errATAIDNotFound is returned when an ATA command addresses sectors
+	// outside the capacity of a device.  Like errATAAbort, it is not
+	// returned by ServeATA.
+	errATAIDNotFound = errors.New("ATA sector ID not found")
+
+	// errATAUncorrectable is returned when an ATA command fails due to an
+	// error reading from or writing to a store.  Like errATAAbort, it is not
+	// returned by ServeATA.
+	errATAUncorrectable = errors.New("ATA uncorrectable media error")
+)
+
+// A Syncer is an object which can commit its written data to stable storage.
+// *os.File implements Syncer.  If the store passed to ServeATA or ServeATAAt
+// implements Syncer, its Sync method is called to serve ATA cache flushes,
+// and after each write while a Target's write cache is disabled.
+type Syncer interface {
+	Sync() error
+}
+
+// ataFlush performs an ATA cache flush request on s using the argument
+// values in r.
+func ataFlush(r *ATAArg, s *ataStore) (*ATAArg, error) {
+	// Only ATA cache flushes allowed here
+	if r.CmdStatus != ATACmdStatusFlush && r.CmdStatus != ATACmdStatusFlushExt {
+		return nil, errATAAbort
+	}
+
+	if err := s.sync(); err != nil {
+		return nil, errATAAbort
+	}
+
+	return &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}, nil
+}
 
 // An Identifier is an object which can return a 512 byte array containing
 // ATA device identification information.
@@ -139,9 +283,10 @@ type Identifier interface {
 	Identify() ([512]byte, error)
 }
 
-// ataIdentify performs an ATA identify request on rs using the argument
-// values in r.
-func ataIdentify(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
+// ataIdentify performs an ATA identify request on s using the argument
+// values in r.  If s is not an Identifier, identification data is generated
+// using the capacity and Identity of t, if t is not nil.
+func ataIdentify(r *ATAArg, s *ataStore, t *Target) (*ATAArg, error) {
 	// Only ATA device identify allowed here
 	if r.CmdStatus != ATACmdStatusIdentify {
 		return nil, errATAAbort
@@ -152,19 +297,29 @@ func ataIdentify(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
 		return nil, errATAAbort
 	}
 
-	// If rs is an Identifier, request its identity directly
-	ident, ok := rs.(Identifier)
-	if !ok {
-		// Currently no generic Identify implementation, as is done in
-		// vblade.
-		// TODO(mdlayher): add generic Identify implementation
-		return nil, ErrNotImplemented
-	}
+	// If s is an Identifier, request its identity directly.  Otherwise,
+	// generate identity information using the size of s, as is done in
+	// vblade.
+	var id [512]byte
+	if idr, ok := s.v.(Identifier); ok {
+		var err error
+		id, err = idr.Identify()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		size, err := ataCapacity(s, t)
+		if err != nil {
+			return nil, err
+		}
 
-	// Retrieve device identity information
-	id, err := ident.Identify()
-	if err != nil {
-		return nil, err
+		var ident *Identity
+		if t != nil {
+			ident = t.Identity
+		}
+
+		_, trim := s.discarder()
+		id = identify(size/sectorSize, ident, t.ataFeatures(), trim)
 	}
 
 	return &ATAArg{
@@ -173,51 +328,92 @@ func ataIdentify(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
 	}, nil
 }
 
-// ataRead performs an ATA 28-bit or 48-bit read request on rs using the
-// argument values in r.
-func ataRead(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
+// ataRead performs an ATA 28-bit or 48-bit read request on s using the
+// argument values in r.  The sectors read must lie within the capacity of
+// s, or of t if it specifies a fixed size.
+func ataRead(r *ATAArg, s *ataStore, t *Target) (*ATAArg, error) {
 	// Only ATA reads allowed here
 	if r.CmdStatus != ATACmdStatusRead28Bit && r.CmdStatus != ATACmdStatusRead48Bit {
 		return nil, errATAAbort
 	}
 
+	b, err := ataReadSectors(r, s, t)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+		Data:      b,
+	}, nil
+}
+
+// ataReadVerify performs an ATA 28-bit or 48-bit read verify request on s
+// using the argument values in r.  The sectors are read as in ataRead, but
+// are not returned.
+func ataReadVerify(r *ATAArg, s *ataStore, t *Target) (*ATAArg, error) {
+	// Only ATA read verifies allowed here
+	if r.CmdStatus != ATACmdStatusReadVerify28Bit && r.CmdStatus != ATACmdStatusReadVerify48Bit {
+		return nil, errATAAbort
+	}
+
+	if _, err := ataReadSectors(r, s, t); err != nil {
+		return nil, err
+	}
+
+	return &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}, nil
+}
+
+// ataReadSectors reads the sectors addressed by r from s, for use by
+// ataRead and ataReadVerify.
+func ataReadSectors(r *ATAArg, s *ataStore, t *Target) ([]byte, error) {
 	// Read must not be flagged as a write
 	if r.FlagWrite {
 		return nil, errATAAbort
 	}
 
-	// Convert LBA to byte offset and seek to correct location
-	offset := calculateLBA(r.LBA, r.FlagLBA48Extended) * sectorSize
-	if _, err := rs.Seek(offset, os.SEEK_SET); err != nil {
+	// Read must lie within device capacity
+	if err := ataCheckBounds(r, s, t); err != nil {
 		return nil, err
 	}
 
+	// A store which cannot be read from cannot serve reads
+	if s.ra == nil {
+		return nil, errATAAbort
+	}
+
+	// Convert LBA to byte offset
+	offset := calculateLBA(r.LBA, r.FlagLBA48Extended) * sectorSize
+
 	// Allocate buffer and read exact (sector count * sector size) bytes from
-	// stream
+	// store, aligned to its physical sectors.  If the store ends early, such
+	// as when it is truncated after its capacity is checked, the sectors
+	// could not be found.  Any other error is reported as a media error.
 	//
 	// TODO(mdlayher): use r.Data instead of allocating?
 	b := make([]byte, int(r.SectorCount)*sectorSize)
-	n, err := rs.Read(b)
-	if err != nil {
-		return nil, err
-	}
-
-	// Verify sector count
-	if sectors := n / sectorSize; sectors != int(r.SectorCount) {
-		return nil, errATAAbort
+	switch _, err := s.readAlignedAt(b, offset, ataAlignment(t)); err {
+	case nil:
+	case io.EOF:
+		return nil, errATAIDNotFound
+	default:
+		return nil, errATAUncorrectable
 	}
 
-	return &ATAArg{
-		CmdStatus: ATACmdStatusReadyStatus,
-		Data:      b,
-	}, nil
+	return b, nil
 }
 
-// ataWrite performs an ATA 28-bit or 48-bit write request on rs using the
-// argument values in r.
-func ataWrite(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
+// ataWrite performs an ATA 28-bit or 48-bit write request, or a write verify
+// request, on s using the argument values in r.  If t specifies a fixed
+// size, the sectors written must lie within it.  Otherwise, writes beyond
+// the end of s grow s.  If t's write cache is disabled, s is synced before
+// the write is acknowledged.
+func ataWrite(r *ATAArg, s *ataStore, t *Target) (*ATAArg, error) {
 	// Only ATA writes allowed here
-	if r.CmdStatus != ATACmdStatusWrite28Bit && r.CmdStatus != ATACmdStatusWrite48Bit {
+	verify := r.CmdStatus == ATACmdStatusWriteVerify
+	if r.CmdStatus != ATACmdStatusWrite28Bit && r.CmdStatus != ATACmdStatusWrite48Bit && !verify {
 		return nil, errATAAbort
 	}
 
@@ -227,35 +423,69 @@ func ataWrite(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
 	}
 
 	// Verify that request data and sector count match up
-	if sectors := len(r.Data) / sectorSize; sectors != int(r.SectorCount) {
+	if len(r.Data) != int(r.SectorCount)*sectorSize {
 		return nil, errATAAbort
 	}
 
-	// Determine if io.ReadSeeker is also an io.Writer, and if a write is
-	// requested
-	rws, ok := rs.(io.ReadWriteSeeker)
-	if !ok {
-		// A write was requested, but the io.ReadSeeker is not an io.Writer
-		return nil, errATAAbort
+	// Write must lie within device capacity, if it is fixed
+	if t != nil && t.Size > 0 {
+		if err := ataCheckBounds(r, s, t); err != nil {
+			return nil, err
+		}
 	}
 
-	// TODO(mdlayher): implement asynchronous writes
+	// A write was requested, but the store cannot be written to, or cannot
+	// be read back to verify the write
+	if s.wa == nil || (verify && s.ra == nil) {
+		return nil, errATAAbort
+	}
 
-	// Convert LBA to byte offset and seek to correct location
+	// Convert LBA to byte offset
 	offset := calculateLBA(r.LBA, r.FlagLBA48Extended) * sectorSize
-	if _, err := rs.Seek(offset, os.SEEK_SET); err != nil {
-		return nil, err
-	}
 
-	// Write data to stream
-	n, err := rws.Write(r.Data)
+	// With the write cache disabled, every write must be durable before it
+	// is acknowledged
+	writeThrough := t.ataFeatures().writeCacheDisabled
+
+	// Write whole physical sectors, preserving the parts of any partial
+	// physical sectors which were not sent by the client
+	align := ataAlignment(t)
+	b, start, done, err := s.alignWrite(r.Data, offset, t)
 	if err != nil {
-		return nil, err
+		return nil, errATAUncorrectable
+	}
+	defer done()
+
+	// If requested, queue asynchronous writes to be applied in the
+	// background, and acknowledge them immediately.  Writes which must be
+	// verified or made durable are always performed synchronously.
+	if aw, ok := s.v.(AsyncWriterAt); ok && r.FlagAsynchronous && !verify && !writeThrough {
+		if err := aw.WriteAtAsync(b, start); err != nil {
+			return nil, errATAAbort
+		}
+
+		return &ATAArg{
+			CmdStatus: ATACmdStatusReadyStatus,
+		}, nil
 	}
 
-	// Verify full sectors written to disk using sector count
-	if sectors := n / sectorSize; sectors != int(r.SectorCount) {
-		return nil, errATAAbort
+	// Write all data to store, reporting any failure as a media error
+	if _, err := s.writeFullAt(b, start); err != nil {
+		return nil, errATAUncorrectable
+	}
+
+	// Read back written data, and verify it matches the data sent
+	if verify {
+		vb := make([]byte, len(r.Data))
+		if _, err := s.readAlignedAt(vb, offset, align); err != nil || !bytes.Equal(vb, r.Data) {
+			return nil, errATAUncorrectable
+		}
+	}
+
+	if writeThrough {
+		if err := s.sync(); err != nil {
+			return nil, errATAAbort
+		}
 	}
 
 	return &ATAArg{
@@ -263,6 +493,33 @@ func ataWrite(r *ATAArg, rs io.ReadSeeker) (*ATAArg, error) {
 	}, nil
 }
 
+// ataCapacity returns the capacity of a device in bytes.  If t specifies a
+// fixed size, it is returned.  Otherwise, the size of s is returned.
+func ataCapacity(s *ataStore, t *Target) (int64, error) {
+	if t != nil && t.Size > 0 {
+		return t.Size, nil
+	}
+
+	return s.size()
+}
+
+// ataCheckBounds verifies that the sectors addressed by r lie within the
+// capacity of a device, as determined by ataCapacity.  Any partial sector at
+// the end of a device cannot be addressed.
+func ataCheckBounds(r *ATAArg, s *ataStore, t *Target) error {
+	size, err := ataCapacity(s, t)
+	if err != nil {
+		return err
+	}
+
+	end := calculateLBA(r.LBA, r.FlagLBA48Extended) + int64(r.SectorCount)
+	if end > size/sectorSize {
+		return errATAIDNotFound
+	}
+
+	return nil
+}
+
 // calculateLBA calculates a logical block address from the LBA array
 // and 48-bit flags from an ATAArg.
 func calculateLBA(rlba [6]uint8, is48Bit bool) int64 {
@@ -58,9 +58,19 @@ func TestServeATA(t *testing.T) {
 				},
 			},
 			w: &ATAArg{
-				SectorCount: 0xff,
-				CmdStatus:   ATACmdStatusReadyStatus,
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "ATA flush ext sync error",
+			r: &Header{
+				Command: CommandIssueATACommand,
+				Arg: &ATAArg{
+					CmdStatus: ATACmdStatusFlushExt,
+				},
 			},
+			rs: &syncer{err: errors.New("foo")},
+			w:  abort,
 		},
 		{
 			desc: "ATA identify abort",
@@ -84,8 +94,8 @@ func TestServeATA(t *testing.T) {
 					SectorCount: 1,
 				},
 			},
-			rs:  &noopReadWriteSeeker{},
-			err: ErrNotImplemented,
+			rs:  &errSeeker{err: errSeekFoo},
+			err: errSeekFoo,
 		},
 		{
 			desc: "ATA read 28-bit abort",
@@ -111,6 +121,54 @@ func TestServeATA(t *testing.T) {
 			},
 			w: abort,
 		},
+		{
+			desc: "ATA read beyond capacity",
+			r: &Header{
+				Command: CommandIssueATACommand,
+				Arg: &ATAArg{
+					CmdStatus:   ATACmdStatusRead28Bit,
+					SectorCount: 1,
+				},
+			},
+			rs: bytes.NewReader(nil),
+			w: &ATAArg{
+				CmdStatus:  ATACmdStatusErrStatus,
+				ErrFeature: ATAErrIDNotFound,
+			},
+		},
+		{
+			desc: "ATA write media error",
+			r: &Header{
+				Command: CommandIssueATACommand,
+				Arg: &ATAArg{
+					FlagWrite:   true,
+					CmdStatus:   ATACmdStatusWrite28Bit,
+					SectorCount: 1,
+					Data:        make([]byte, sectorSize),
+				},
+			},
+			rs: &errWriter{err: errors.New("foo")},
+			w: &ATAArg{
+				CmdStatus:  ATACmdStatusErrStatus,
+				ErrFeature: ATAErrUncorrectable,
+			},
+		},
+		{
+			desc: "ATA SMART return status",
+			r: &Header{
+				Command: CommandIssueATACommand,
+				Arg: &ATAArg{
+					CmdStatus:  ATACmdStatusSMART,
+					ErrFeature: smartReturnStatus,
+					LBA:        [6]uint8{1: smartLBAMid, 2: smartLBAHigh},
+				},
+			},
+			rs: bytes.NewReader(nil),
+			w: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				LBA:       [6]uint8{1: smartLBAMid, 2: smartLBAHigh},
+			},
+		},
 		{
 			desc: "ATA write 28-bit abort",
 			r: &Header{
@@ -136,14 +194,18 @@ func TestServeATA(t *testing.T) {
 			w: abort,
 		},
 		{
-			desc: "ATA ready status",
+			desc: "ATA read verify",
 			r: &Header{
 				Command: CommandIssueATACommand,
 				Arg: &ATAArg{
-					CmdStatus: ATACmdStatusReadyStatus,
+					CmdStatus:   ATACmdStatusReadVerify28Bit,
+					SectorCount: 1,
 				},
 			},
-			w: nil,
+			rs: bytes.NewReader(make([]byte, sectorSize)),
+			w: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
 		},
 		{
 			desc: "ATA unknown command abort",
@@ -160,7 +222,7 @@ func TestServeATA(t *testing.T) {
 	for i, tt := range tests {
 		w := &captureHeaderResponseSender{h: &Header{}}
 
-		if _, err := ServeATA(w, tt.r, tt.rs); err != nil || tt.err != nil {
+		if _, err := ServeATA(w, &Request{Header: tt.r}, tt.rs); err != nil || tt.err != nil {
 			if want, got := tt.err, err; want != got {
 				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
 					i, tt.desc, want, got)
@@ -169,22 +231,33 @@ func TestServeATA(t *testing.T) {
 			continue
 		}
 
-		want, got := tt.w, w.h.Arg
-		if tt.r.Arg.(*ATAArg).CmdStatus == ATACmdStatusReadyStatus {
-			if want != nil && got != nil {
-				t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
-					i, tt.desc, want, got)
-			}
-			continue
-		}
-
-		if !reflect.DeepEqual(want, got) {
+		if want, got := tt.w, w.h.Arg; !reflect.DeepEqual(want, got) {
 			t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
 				i, tt.desc, want, got)
 		}
 	}
 }
 
+func TestATAHandler(t *testing.T) {
+	w := &captureHeaderResponseSender{}
+	ATAHandler(nil).ServeAoE(w, &Request{
+		Header: &Header{
+			Command: CommandIssueATACommand,
+			Arg: &ATAArg{
+				CmdStatus: ATACmdStatusCheckPower,
+			},
+		},
+	})
+
+	want := &ATAArg{
+		SectorCount: 0xff,
+		CmdStatus:   ATACmdStatusReadyStatus,
+	}
+	if got := w.h.Arg; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected ATAArg:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
 // captureHeaderResponseSender is a ResponseSender which captures the header
 // passed to it in Send.
 type captureHeaderResponseSender struct {
@@ -204,6 +277,7 @@ func Test_ataRead(t *testing.T) {
 		desc string
 		rarg *ATAArg
 		rs   io.ReadSeeker
+		t    *Target
 		warg *ATAArg
 		err  error
 	}{
@@ -235,15 +309,17 @@ func Test_ataRead(t *testing.T) {
 		{
 			desc: "error during Read",
 			rarg: &ATAArg{
-				CmdStatus: ATACmdStatusRead48Bit,
+				CmdStatus:   ATACmdStatusRead48Bit,
+				SectorCount: 1,
 			},
 			rs: &errReader{
 				err: errFoo,
 			},
-			err: errFoo,
+			t:   &Target{Size: sectorSize},
+			err: errATAUncorrectable,
 		},
 		{
-			desc: "read wrong number of bytes",
+			desc: "short reads",
 			rarg: &ATAArg{
 				CmdStatus:   ATACmdStatusRead28Bit,
 				SectorCount: 1,
@@ -251,7 +327,53 @@ func Test_ataRead(t *testing.T) {
 			rs: &nReader{
 				n: sectorSize - 1,
 			},
-			err: errATAAbort,
+			t: &Target{Size: sectorSize},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				Data:      make([]byte, sectorSize),
+			},
+		},
+		{
+			desc: "read makes no progress",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusRead28Bit,
+				SectorCount: 1,
+			},
+			rs: &nReader{
+				n: 0,
+			},
+			t:   &Target{Size: sectorSize},
+			err: errATAUncorrectable,
+		},
+		{
+			desc: "read reaches end of io.ReadSeeker before fixed size",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusRead28Bit,
+				SectorCount: 2,
+			},
+			rs:  bytes.NewReader(make([]byte, sectorSize)),
+			t:   &Target{Size: sectorSize * 2},
+			err: errATAIDNotFound,
+		},
+		{
+			desc: "read beyond end of io.ReadSeeker",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusRead28Bit,
+				LBA:         [6]uint8{1},
+				SectorCount: 2,
+			},
+			rs:  bytes.NewReader(make([]byte, sectorSize*2+10)),
+			err: errATAIDNotFound,
+		},
+		{
+			desc: "read beyond fixed size",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusRead28Bit,
+				SectorCount: 2,
+			},
+			rs:  bytes.NewReader(make([]byte, sectorSize*4)),
+			t:   &Target{Size: sectorSize},
+			err: errATAIDNotFound,
 		},
 		{
 			desc: "read OK",
@@ -262,6 +384,7 @@ func Test_ataRead(t *testing.T) {
 			rs: &nReader{
 				n: sectorSize * 2,
 			},
+			t: &Target{Size: sectorSize * 2},
 			warg: &ATAArg{
 				CmdStatus: ATACmdStatusReadyStatus,
 				Data:      make([]byte, sectorSize*2),
@@ -270,7 +393,7 @@ func Test_ataRead(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		warg, err := ataRead(tt.rarg, tt.rs)
+		warg, err := ataRead(tt.rarg, newATAStore(tt.rs), tt.t)
 		if err != nil || tt.err != nil {
 			if want, got := tt.err, err; want != got {
 				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
@@ -295,6 +418,7 @@ func Test_ataWrite(t *testing.T) {
 		desc string
 		rarg *ATAArg
 		rs   io.ReadSeeker
+		t    *Target
 		warg *ATAArg
 		err  error
 	}{
@@ -335,27 +459,31 @@ func Test_ataWrite(t *testing.T) {
 		{
 			desc: "error during Seek",
 			rarg: &ATAArg{
-				FlagWrite: true,
-				CmdStatus: ATACmdStatusWrite48Bit,
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWrite48Bit,
+				SectorCount: 1,
+				Data:        make([]byte, sectorSize),
 			},
 			rs: &errSeeker{
 				err: errFoo,
 			},
-			err: errFoo,
+			err: errATAUncorrectable,
 		},
 		{
 			desc: "error during Write",
 			rarg: &ATAArg{
-				FlagWrite: true,
-				CmdStatus: ATACmdStatusWrite48Bit,
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWrite48Bit,
+				SectorCount: 1,
+				Data:        make([]byte, sectorSize),
 			},
 			rs: &errWriter{
 				err: errFoo,
 			},
-			err: errFoo,
+			err: errATAUncorrectable,
 		},
 		{
-			desc: "wrong amount of data written",
+			desc: "short writes",
 			rarg: &ATAArg{
 				FlagWrite:   true,
 				CmdStatus:   ATACmdStatusWrite48Bit,
@@ -365,7 +493,85 @@ func Test_ataWrite(t *testing.T) {
 			rs: &nWriter{
 				n: sectorSize - 1,
 			},
-			err: errATAAbort,
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "write makes no progress",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWrite48Bit,
+				SectorCount: 1,
+				Data:        make([]byte, sectorSize),
+			},
+			rs: &nWriter{
+				n: 0,
+			},
+			err: errATAUncorrectable,
+		},
+		{
+			desc: "write beyond fixed size",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWrite48Bit,
+				LBA:         [6]uint8{1},
+				SectorCount: 1,
+				Data:        make([]byte, sectorSize),
+			},
+			rs:  &countWriter{},
+			t:   &Target{Size: sectorSize},
+			err: errATAIDNotFound,
+		},
+		{
+			desc: "write beyond end of io.ReadSeeker",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWrite48Bit,
+				LBA:         [6]uint8{1},
+				SectorCount: 1,
+				Data:        make([]byte, sectorSize),
+			},
+			rs: &countWriter{},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "write verify OK",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWriteVerify,
+				LBA:         [6]uint8{1},
+				SectorCount: 1,
+				Data:        bytes.Repeat([]byte{0xaa}, sectorSize),
+			},
+			rs: newMemStore(sectorSize * 2),
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "write verify mismatch",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWriteVerify,
+				SectorCount: 1,
+				Data:        bytes.Repeat([]byte{0xaa}, sectorSize),
+			},
+			rs:  &lossyReadWriteSeeker{},
+			err: errATAUncorrectable,
+		},
+		{
+			desc: "write verify read back error",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusWriteVerify,
+				SectorCount: 1,
+				Data:        make([]byte, sectorSize),
+			},
+			rs:  &countWriter{},
+			err: errATAUncorrectable,
 		},
 		{
 			desc: "write OK",
@@ -383,7 +589,169 @@ func Test_ataWrite(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		warg, err := ataWrite(tt.rarg, tt.rs)
+		warg, err := ataWrite(tt.rarg, newATAStore(tt.rs), tt.t)
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.warg, warg; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_ataReadVerify(t *testing.T) {
+	var tests = []struct {
+		desc string
+		rarg *ATAArg
+		rs   io.ReadSeeker
+		warg *ATAArg
+		err  error
+	}{
+		{
+			desc: "non-ATA read verify command",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusRead28Bit,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "flagged as write",
+			rarg: &ATAArg{
+				FlagWrite: true,
+				CmdStatus: ATACmdStatusReadVerify28Bit,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "verify beyond end of io.ReadSeeker",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusReadVerify48Bit,
+				LBA:         [6]uint8{1},
+				SectorCount: 2,
+			},
+			rs:  bytes.NewReader(make([]byte, sectorSize*2)),
+			err: errATAIDNotFound,
+		},
+		{
+			desc: "error during Read",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusReadVerify28Bit,
+				SectorCount: 1,
+			},
+			rs: &sizer{
+				noopReadWriteSeeker: noopReadWriteSeeker{},
+				size:                sectorSize,
+			},
+			err: errATAUncorrectable,
+		},
+		{
+			desc: "verify OK",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusReadVerify48Bit,
+				LBA:         [6]uint8{1},
+				SectorCount: 1,
+			},
+			rs: bytes.NewReader(make([]byte, sectorSize*2)),
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		warg, err := ataReadVerify(tt.rarg, newATAStore(tt.rs), nil)
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.warg, warg; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_ataFlush(t *testing.T) {
+	var tests = []struct {
+		desc  string
+		rarg  *ATAArg
+		rs    io.ReadSeeker
+		warg  *ATAArg
+		syncs int
+		err   error
+	}{
+		{
+			desc: "non-ATA flush command",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusCheckPower,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "not Syncer",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusFlush,
+			},
+			rs: &noopReadWriteSeeker{},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "sync error",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusFlush,
+			},
+			rs:    &syncer{err: errors.New("foo")},
+			syncs: 1,
+			err:   errATAAbort,
+		},
+		{
+			desc: "flush OK",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusFlush,
+			},
+			rs:    &syncer{},
+			syncs: 1,
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "flush ext OK",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusFlushExt,
+			},
+			rs:    &syncer{},
+			syncs: 1,
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		warg, err := ataFlush(tt.rarg, newATAStore(tt.rs))
+
+		if s, ok := tt.rs.(*syncer); ok {
+			if want, got := tt.syncs, s.n; want != got {
+				t.Fatalf("[%02d] test %q, unexpected number of syncs: %v != %v",
+					i, tt.desc, want, got)
+			}
+		}
+
 		if err != nil || tt.err != nil {
 			if want, got := tt.err, err; want != got {
 				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
@@ -407,6 +775,9 @@ func Test_ataIdentify(t *testing.T) {
 	// Blank ATA device identifier since we don't do any introspection
 	id := [512]byte{}
 
+	// Generated ATA device identifier for a 4 sector device
+	gen := identify(4, nil, ataFeatures{}, false)
+
 	var tests = []struct {
 		desc string
 		rarg *ATAArg
@@ -443,8 +814,20 @@ func Test_ataIdentify(t *testing.T) {
 				CmdStatus:   ATACmdStatusIdentify,
 				SectorCount: 1,
 			},
-			rs:  bytes.NewReader(nil),
-			err: ErrNotImplemented,
+			rs: bytes.NewReader(make([]byte, 4*sectorSize)),
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				Data:      gen[:],
+			},
+		},
+		{
+			desc: "io.ReadSeeker size error",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusIdentify,
+				SectorCount: 1,
+			},
+			rs:  &errSeeker{err: errFoo},
+			err: errFoo,
 		},
 		{
 			desc: "identify error",
@@ -472,7 +855,7 @@ func Test_ataIdentify(t *testing.T) {
 	}
 
 	for i, tt := range tests {
-		warg, err := ataIdentify(tt.rarg, tt.rs)
+		warg, err := ataIdentify(tt.rarg, newATAStore(tt.rs), nil)
 		if err != nil || tt.err != nil {
 			if want, got := tt.err, err; want != got {
 				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
@@ -524,13 +907,18 @@ func Test_calculateLBA(t *testing.T) {
 	}
 }
 
-// nReader returns the value of its n field bytes whenever its Read method is called.
+// nReader returns at most the value of its n field bytes whenever its Read
+// method is called.
 type nReader struct {
 	n int
 	noopReadWriteSeeker
 }
 
 func (r *nReader) Read(p []byte) (int, error) {
+	if len(p) < r.n {
+		return len(p), nil
+	}
+
 	return r.n, nil
 }
 
@@ -573,16 +961,36 @@ func (w *countWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-// nWriter returns the value of its n field bytes whenever its Write method is called.
+// nWriter returns at most the value of its n field bytes whenever its Write
+// method is called.
 type nWriter struct {
 	n int
 	noopReadWriteSeeker
 }
 
 func (w *nWriter) Write(p []byte) (int, error) {
+	if len(p) < w.n {
+		return len(p), nil
+	}
+
 	return w.n, nil
 }
 
+// lossyReadWriteSeeker accepts all writes, but always reads back zeros.
+type lossyReadWriteSeeker struct {
+	noopReadWriteSeeker
+}
+
+func (lossyReadWriteSeeker) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
+
+func (lossyReadWriteSeeker) Write(p []byte) (int, error) { return len(p), nil }
+
 // errIdentifier returns the err field whenever its Identify method is called.
 type errIdentifier struct {
 	noopReadWriteSeeker
@@ -593,6 +1001,21 @@ func (i *errIdentifier) Identify() ([512]byte, error) {
 	return [512]byte{}, i.err
 }
 
+// errSeekFoo is returned by errSeeker in ServeATA tests.
+var errSeekFoo = errors.New("seek foo")
+
+// syncer counts calls to its Sync method, and returns its err field.
+type syncer struct {
+	noopReadWriteSeeker
+	n   int
+	err error
+}
+
+func (s *syncer) Sync() error {
+	s.n++
+	return s.err
+}
+
 // noopReadWriteSeeker is the no-op basis for other io.ReadWriteSeeker implementations.
 type noopReadWriteSeeker struct{}
 
@@ -0,0 +1,442 @@
+package aoe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+var (
+	// ErrClientClosed is returned by Client methods after a call to
+	// Client.Close.
+	ErrClientClosed = errors.New("client closed")
+
+	// ErrNoResponse is returned when a request does not receive a response
+	// before its timeout expires.
+	ErrNoResponse = errors.New("no response")
+)
+
+// A Client is an ATA over Ethernet client.  A Client sends requests to
+// AoE servers over one or more Conns, and correlates responses with requests
+// using the Tag field of each Header.
+//
+// Once a target has been opened using OpenDevice, the Client tracks the
+// smoothed round trip time for each path to the target, and retransmits
+// unicast requests to it which are not answered within the retransmission
+// timeout.  The number of outstanding requests using each path is limited
+// by a window which shrinks on loss and grows on success, and which never
+// exceeds the target's advertised buffer count.
+//
+// A Client is safe for concurrent use.
+type Client struct {
+	// Timeout specifies the maximum amount of time to wait for a response
+	// to a single request, if the request's context does not specify an
+	// earlier deadline.  If zero, requests wait until their context is
+	// canceled.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	conns   []*clientConn
+	loops   int
+	tag     uint32
+	pending map[[4]byte]chan<- *reply
+	targets map[targetAddr]*pathSet
+	err     error
+
+	done chan struct{}
+}
+
+// A reply is a response Header received by a Client, along with the hardware
+// address of the server which sent it, and the Conn it was received on.
+type reply struct {
+	h    *Header
+	src  net.HardwareAddr
+	conn *clientConn
+}
+
+// NewClient creates a new Client which sends and receives AoE messages
+// using c.  The hardware address of ifi is used as the source address for
+// all requests sent using c.  Additional Conns may be added using
+// AddInterface.
+//
+// NewClient starts a goroutine which reads responses from c.  Call Close
+// to stop the goroutine and close c.
+func NewClient(c Conn, ifi *net.Interface) *Client {
+	cl := &Client{
+		pending: make(map[[4]byte]chan<- *reply),
+		targets: make(map[targetAddr]*pathSet),
+		done:    make(chan struct{}),
+	}
+
+	cl.mu.Lock()
+	cl.addConnLocked(c, ifi)
+	cl.mu.Unlock()
+
+	return cl
+}
+
+// Close closes the Client's Conns, and causes all outstanding requests to
+// return ErrClientClosed.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrClientClosed
+	}
+	conns := c.conns
+	c.mu.Unlock()
+
+	var err error
+	for _, cc := range conns {
+		if cerr := cc.c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	<-c.done
+
+	return err
+}
+
+// Do sends request Header h to the AoE server with hardware address dst,
+// and waits for a response.  If dst is nil, the request is broadcast to all
+// servers using every Conn, and the first response is returned.
+//
+// Do fills in the Version and Tag fields of h.  A response is matched to h
+// when its FlagResponse field is set and its Tag matches h's Tag.  If the
+// response's FlagError field is set, its Error value is returned as an
+// error.
+//
+// If c.Timeout or a deadline set on ctx expires before a response arrives,
+// ErrNoResponse is returned.  If ctx is otherwise canceled, ctx.Err() is
+// returned.
+func (c *Client) Do(ctx context.Context, dst net.HardwareAddr, h *Header) (*Header, error) {
+	var res *Header
+	err := c.roundTrip(ctx, dst, h, 1, func(r *reply) bool {
+		res = r.h
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if res.FlagError {
+		return nil, res.Error
+	}
+
+	return res, nil
+}
+
+// roundTrip sends request Header h to dst, and invokes fn for each response
+// received until fn returns false, or the request times out.  Up to n
+// responses are queued while fn is running; further responses are dropped.
+//
+// If dst is nil, h is broadcast using every Conn.  Otherwise, h is sent
+// using the known paths to h's target via dst.
+//
+// If fn returned false, roundTrip returns nil.  Otherwise, it returns the
+// reason the request ended.
+func (c *Client) roundTrip(ctx context.Context, dst net.HardwareAddr, h *Header, n int, fn func(r *reply) bool) error {
+	var paths []*path
+	if dst != nil {
+		paths = c.pathsTo(h.Major, h.Minor, dst)
+	}
+
+	return c.exchange(ctx, paths, h, n, fn)
+}
+
+// exchange sends request Header h using the first of paths, and invokes fn
+// for each response as described in roundTrip.  If paths is empty, h is
+// broadcast using every Conn.
+//
+// If the path in use has a window, h is retransmitted with exponential
+// backoff until a response arrives.  Each retransmission moves h to the
+// next of paths, so that a request is not lost when a path stops
+// responding.
+func (c *Client) exchange(ctx context.Context, paths []*path, h *Header, n int, fn func(r *reply) bool) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	// Use the first path, subject to its flow control window
+	var p *path
+	if len(paths) > 0 {
+		if err := paths[0].acquire(ctx); err != nil {
+			return ctxErr(ctx)
+		}
+		p = paths[0]
+
+		// p changes on failover, so release whichever path is in use
+		defer func() {
+			if p != nil {
+				p.release()
+			}
+		}()
+	}
+
+	// Buffer responses so the read loop is never blocked
+	replyC := make(chan *reply, n)
+	tag, err := c.register(replyC)
+	if err != nil {
+		return err
+	}
+	defer c.unregister(tag)
+
+	h.Version = Version
+	h.FlagResponse = false
+	h.Tag = tag
+
+	if p == nil {
+		if err := c.broadcast(h); err != nil {
+			return err
+		}
+	} else {
+		if err := c.send(p.conn, p.mac, h); err != nil {
+			return err
+		}
+	}
+	sent := time.Now()
+
+	// Requests subject to flow control are retransmitted with exponential
+	// backoff until a response arrives
+	var (
+		i             int
+		rto           time.Duration
+		retransmitted bool
+		timer         *time.Timer
+		timeout       <-chan time.Time
+	)
+	if p != nil {
+		if rto = p.rto(); rto > 0 {
+			timer = time.NewTimer(rto)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+	}
+
+	for {
+		select {
+		case <-timeout:
+			p.loss()
+			retransmitted = true
+			rto = clampRTO(2 * rto)
+
+			// Fail over to the next path, if one is available
+			if len(paths) > 1 {
+				p.release()
+				i = (i + 1) % len(paths)
+				next := paths[i]
+				if err := next.acquire(ctx); err != nil {
+					p = nil
+					return ctxErr(ctx)
+				}
+				p = next
+
+				if prto := p.rto(); prto > rto {
+					rto = prto
+				}
+			}
+
+			if err := c.send(p.conn, p.mac, h); err != nil {
+				return err
+			}
+			timer.Reset(rto)
+		case <-ctx.Done():
+			return ctxErr(ctx)
+		case <-c.done:
+			return c.closeErr()
+		case r := <-replyC:
+			if timeout != nil {
+				// Per Karn's algorithm, retransmitted requests are not
+				// used to estimate round trip time
+				var rtt time.Duration
+				if !retransmitted {
+					rtt = time.Since(sent)
+				}
+
+				for _, pp := range paths {
+					if pp.is(r.conn, r.src) {
+						pp.success(rtt)
+					}
+				}
+				timeout = nil
+			}
+
+			if !fn(r) {
+				return nil
+			}
+		}
+	}
+}
+
+// ctxErr returns ErrNoResponse if ctx's deadline was exceeded, or ctx.Err()
+// otherwise.
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrNoResponse
+	}
+
+	return ctx.Err()
+}
+
+// broadcast sends h to all servers using every Conn which is still
+// running.  An error is returned only if h could not be sent using any Conn.
+func (c *Client) broadcast(h *Header) error {
+	c.mu.Lock()
+	var conns []*clientConn
+	for _, cc := range c.conns {
+		if cc.err == nil {
+			conns = append(conns, cc)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(conns) == 0 {
+		return c.closeErr()
+	}
+
+	var err error
+	var sent bool
+	for _, cc := range conns {
+		if serr := c.send(cc, ethernet.Broadcast, h); serr != nil {
+			err = serr
+			continue
+		}
+		sent = true
+	}
+	if sent {
+		return nil
+	}
+
+	return err
+}
+
+// send marshals h into an Ethernet frame addressed to dst, and writes it
+// using Conn cc.
+func (c *Client) send(cc *clientConn, dst net.HardwareAddr, h *Header) error {
+	hb, err := h.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	f := &ethernet.Frame{
+		Destination: dst,
+		Source:      cc.ifi.HardwareAddr,
+		EtherType:   EtherType,
+		Payload:     hb,
+	}
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = cc.c.WriteFrame(fb)
+	return err
+}
+
+// register allocates a unique Tag for a request, and registers replyC to
+// receive responses carrying that Tag.
+func (c *Client) register(replyC chan<- *reply) ([4]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return [4]byte{}, c.err
+	}
+
+	// Skip any tags which are still in use after the counter wraps
+	var tag [4]byte
+	for {
+		c.tag++
+		binary.BigEndian.PutUint32(tag[:], c.tag)
+		if _, ok := c.pending[tag]; !ok {
+			break
+		}
+	}
+
+	c.pending[tag] = replyC
+	return tag, nil
+}
+
+// unregister releases a Tag allocated by register.
+func (c *Client) unregister(tag [4]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.pending, tag)
+}
+
+// closeErr returns the reason the Client's read loops stopped.
+func (c *Client) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// readLoop reads responses from Conn cc, and delivers them to the requests
+// which are waiting for them.  When the last read loop stops, the Client is
+// closed.
+func (c *Client) readLoop(cc *clientConn) {
+	var err error
+	defer func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		cc.err = err
+		c.loops--
+		if c.loops > 0 {
+			return
+		}
+
+		if c.err == nil {
+			c.err = err
+		}
+		close(c.done)
+	}()
+
+	b := make([]byte, maxFrameLen)
+	for {
+		var n int
+		n, err = cc.c.ReadFrame(b)
+		if err != nil {
+			return
+		}
+
+		f := new(ethernet.Frame)
+		if err := f.UnmarshalBinary(b[:n]); err != nil {
+			continue
+		}
+		if f.EtherType != EtherType {
+			continue
+		}
+
+		h := new(Header)
+		if err := h.UnmarshalBinary(trimPadding(f.Payload)); err != nil {
+			continue
+		}
+
+		// Ignore requests from other clients
+		if !h.FlagResponse {
+			continue
+		}
+
+		c.mu.Lock()
+		replyC, ok := c.pending[h.Tag]
+		c.mu.Unlock()
+		if !ok {
+			continue
+		}
+
+		// Drop responses if the requester is not keeping up
+		select {
+		case replyC <- &reply{h: h, src: f.Source, conn: cc}:
+		default:
+		}
+	}
+}
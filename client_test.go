@@ -0,0 +1,227 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientDo(t *testing.T) {
+	target := &Target{
+		Major:       1,
+		Minor:       2,
+		BufferCount: 16,
+	}
+	if err := target.SetConfig([]byte("foo")); err != nil {
+		t.Fatalf("failed to set config: %v", err)
+	}
+
+	c, done := testClientServer(t, nil, target)
+	defer done()
+
+	var tests = []struct {
+		desc string
+		c    ConfigCommand
+		s    string
+		res  string
+		err  error
+	}{
+		{
+			desc: "read",
+			c:    ConfigCommandRead,
+			res:  "foo",
+		},
+		{
+			desc: "set, config string present",
+			c:    ConfigCommandSet,
+			s:    "bar",
+			err:  ErrorConfigStringPresent,
+		},
+	}
+
+	for i, tt := range tests {
+		h := configRequest(tt.c, tt.s)
+		h.Major = 1
+		h.Minor = 2
+
+		res, err := c.Do(context.Background(), serverMAC, h)
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := h.Tag, res.Tag; want != got {
+			t.Fatalf("[%02d] test %q, unexpected Tag: %v != %v",
+				i, tt.desc, want, got)
+		}
+
+		arg := res.Arg.(*ConfigArg)
+		if want, got := []byte(tt.res), arg.String; !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected config string: %q != %q",
+				i, tt.desc, want, got)
+		}
+		if want, got := uint16(16), arg.BufferCount; want != got {
+			t.Fatalf("[%02d] test %q, unexpected buffer count: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestClientDoUniqueTags(t *testing.T) {
+	c, done := testClientServer(t, nil, &Target{Major: 1, Minor: 2})
+	defer done()
+
+	tags := make(map[[4]byte]bool)
+	for i := 0; i < 8; i++ {
+		h := configRequest(ConfigCommandRead, "")
+		h.Major = 1
+		h.Minor = 2
+
+		if _, err := c.Do(context.Background(), nil, h); err != nil {
+			t.Fatalf("failed to perform request: %v", err)
+		}
+
+		if tags[h.Tag] {
+			t.Fatalf("tag reused: %v", h.Tag)
+		}
+		tags[h.Tag] = true
+	}
+}
+
+func TestClientDoNoResponse(t *testing.T) {
+	c, done := testClientServer(t, nil, &Target{Major: 1, Minor: 2})
+	defer done()
+
+	// Target does not exist, so no response is sent
+	h := configRequest(ConfigCommandRead, "")
+	h.Major = 2
+	h.Minor = 2
+
+	c.Timeout = 10 * time.Millisecond
+	if want, got := ErrNoResponse, func() error {
+		_, err := c.Do(context.Background(), nil, h)
+		return err
+	}(); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	c.Timeout = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if want, got := context.Canceled, func() error {
+		_, err := c.Do(ctx, nil, h)
+		return err
+	}(); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	cc, _ := newMemConnPair()
+	c := NewClient(cc, &net.Interface{HardwareAddr: clientMAC})
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := c.Do(context.Background(), nil, testRequest())
+		errC <- err
+	}()
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("failed to close client: %v", err)
+	}
+	if want, got := ErrClientClosed, <-errC; want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	if _, err := c.Do(context.Background(), nil, testRequest()); err != ErrClientClosed {
+		t.Fatalf("unexpected error after close: %v", err)
+	}
+}
+
+func TestClientRetransmit(t *testing.T) {
+	target := &Target{
+		Major:       1,
+		Minor:       2,
+		BufferCount: 4,
+		SectorCount: 1,
+	}
+
+	// Drop the first ATA request, so it must be retransmitted
+	disk := &memDisk{b: make([]byte, 2*sectorSize)}
+	copy(disk.b, "foo")
+
+	var dropped int32
+	mux := NewTargetServeMux()
+	mux.HandleFunc(CommandIssueATACommand, func(w ResponseSender, r *Request) {
+		if atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+			return
+		}
+
+		disk.ServeAoE(w, r)
+	})
+
+	c, done := testClientServer(t, mux, target)
+	defer done()
+
+	d, err := c.OpenDevice(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatalf("failed to open device: %v", err)
+	}
+
+	p := make([]byte, 3)
+	if _, err := d.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if want, got := []byte("foo"), p; !bytes.Equal(want, got) {
+		t.Fatalf("unexpected data: %q != %q", want, got)
+	}
+
+	// Only the retransmission was served, and the window remains at its
+	// minimum size
+	if want, got := 1, disk.commands(); want != got {
+		t.Fatalf("unexpected number of ATA commands: %v != %v", want, got)
+	}
+
+	w := c.paths(1, 2)[0].w
+	if want, got := 1, w.size; want != got {
+		t.Fatalf("unexpected window size: %v != %v", want, got)
+	}
+	if want, got := 4, w.max; want != got {
+		t.Fatalf("unexpected maximum window size: %v != %v", want, got)
+	}
+}
+
+// testClientServer creates a Client connected to a Server with Handler h,
+// which serves targets.  Invoke the returned function to stop both.
+func testClientServer(t *testing.T, h Handler, targets ...*Target) (*Client, func()) {
+	s := testServer(h)
+	s.Targets = NewTargetRegistry()
+	for _, target := range targets {
+		if err := s.Targets.Add(target); err != nil {
+			t.Fatalf("failed to add target: %v", err)
+		}
+	}
+
+	sc, cc := newMemConnPair()
+	serveDone := make(chan struct{})
+	go func() {
+		defer close(serveDone)
+		_ = s.Serve(sc)
+	}()
+
+	c := NewClient(cc, &net.Interface{HardwareAddr: clientMAC})
+
+	return c, func() {
+		_ = c.Close()
+		_ = s.Shutdown(context.Background())
+		<-serveDone
+	}
+}
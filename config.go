@@ -0,0 +1,99 @@
+package aoe
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	// ErrInvalidConfigRequest is returned when an invalid config request is
+	// rejected by ServeConfig.
+	ErrInvalidConfigRequest = errors.New("invalid config request")
+)
+
+// ServeConfig replies to an AoE Query Config Information request using the
+// config string and settings of Target t, as described in AoEr11, Section 3.2.
+//
+// ServeConfig returns the number of bytes transmitted to a client, and any
+// errors which occurred while processing a request.
+//
+// ServeConfig handles each ConfigCommand as follows:
+//   - ConfigCommandRead: reply with t's config string.
+//   - ConfigCommandTest: reply only if the argument string exactly matches
+//     t's config string.
+//   - ConfigCommandTestPrefix: reply only if the argument string is a prefix
+//     of t's config string.
+//   - ConfigCommandSet: if t's config string is empty, set it to the argument
+//     string and reply.  Otherwise, reply with ErrorConfigStringPresent.
+//   - ConfigCommandForceSet: set t's config string to the argument string,
+//     and always reply.
+//
+// Unknown ConfigCommand values are answered with ErrorBadArgumentParameter.
+// If no reply is sent, ServeConfig returns 0 and a nil error.
+//
+// If r.Command is not CommandQueryConfigInformation, or r.Arg is not a
+// *ConfigArg, ErrInvalidConfigRequest is returned.
+func ServeConfig(w ResponseSender, r *Request, t *Target) (int, error) {
+	// Ensure request intends to query config information
+	if r.Command != CommandQueryConfigInformation {
+		return 0, ErrInvalidConfigRequest
+	}
+	arg, ok := r.Arg.(*ConfigArg)
+	if !ok {
+		return 0, ErrInvalidConfigRequest
+	}
+
+	switch arg.Command {
+	case ConfigCommandRead:
+		// Always reply with current config string
+	case ConfigCommandTest:
+		// Reply only on exact match
+		if !bytes.Equal(arg.String, t.Config()) {
+			return 0, nil
+		}
+	case ConfigCommandTestPrefix:
+		// Reply only on prefix match
+		if !bytes.HasPrefix(t.Config(), arg.String) {
+			return 0, nil
+		}
+	case ConfigCommandSet:
+		// Set only if no config string is present
+		if !t.setConfigIfEmpty(arg.String) {
+			return w.Send(&Header{
+				Error: ErrorConfigStringPresent,
+			})
+		}
+	case ConfigCommandForceSet:
+		// Always set config string and reply
+		if err := t.SetConfig(arg.String); err != nil {
+			return 0, err
+		}
+	default:
+		return w.Send(&Header{
+			Error: ErrorBadArgumentParameter,
+		})
+	}
+
+	config := t.Config()
+	return w.Send(&Header{
+		Arg: &ConfigArg{
+			BufferCount:     t.BufferCount,
+			FirmwareVersion: t.FirmwareVersion,
+			SectorCount:     t.SectorCount,
+			Version:         Version,
+			Command:         arg.Command,
+			StringLength:    uint16(len(config)),
+			String:          config,
+		},
+	})
+}
+
+// serveTargetConfig serves AoE Query Config Information requests using the
+// Target associated with r.  Requests with no associated Target are ignored.
+func serveTargetConfig(w ResponseSender, r *Request) {
+	if r.Target == nil {
+		return
+	}
+
+	_, _ = ServeConfig(w, r, r.Target)
+}
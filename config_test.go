@@ -0,0 +1,158 @@
+package aoe
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestServeConfig(t *testing.T) {
+	// reply creates the expected reply Header for a Target with config
+	// string s, in response to ConfigCommand c
+	reply := func(c ConfigCommand, s string) *Header {
+		return &Header{
+			Arg: &ConfigArg{
+				BufferCount:     16,
+				FirmwareVersion: 1,
+				SectorCount:     2,
+				Version:         Version,
+				Command:         c,
+				StringLength:    uint16(len(s)),
+				String:          []byte(s),
+			},
+		}
+	}
+
+	var tests = []struct {
+		desc   string
+		r      *Header
+		config string
+		w      *Header
+		after  string
+		err    error
+	}{
+		{
+			desc: "not CommandQueryConfigInformation",
+			r: &Header{
+				Command: CommandIssueATACommand,
+			},
+			err: ErrInvalidConfigRequest,
+		},
+		{
+			desc: "not ConfigArg",
+			r: &Header{
+				Command: CommandQueryConfigInformation,
+				Arg:     &ATAArg{},
+			},
+			err: ErrInvalidConfigRequest,
+		},
+		{
+			desc:   "read",
+			r:      configRequest(ConfigCommandRead, ""),
+			config: "foo",
+			w:      reply(ConfigCommandRead, "foo"),
+			after:  "foo",
+		},
+		{
+			desc:   "test, no match",
+			r:      configRequest(ConfigCommandTest, "fo"),
+			config: "foo",
+			after:  "foo",
+		},
+		{
+			desc:   "test, match",
+			r:      configRequest(ConfigCommandTest, "foo"),
+			config: "foo",
+			w:      reply(ConfigCommandTest, "foo"),
+			after:  "foo",
+		},
+		{
+			desc:   "test prefix, no match",
+			r:      configRequest(ConfigCommandTestPrefix, "bar"),
+			config: "foo",
+			after:  "foo",
+		},
+		{
+			desc:   "test prefix, match",
+			r:      configRequest(ConfigCommandTestPrefix, "fo"),
+			config: "foo",
+			w:      reply(ConfigCommandTestPrefix, "foo"),
+			after:  "foo",
+		},
+		{
+			desc:   "set, config string present",
+			r:      configRequest(ConfigCommandSet, "bar"),
+			config: "foo",
+			w: &Header{
+				Error: ErrorConfigStringPresent,
+			},
+			after: "foo",
+		},
+		{
+			desc:  "set, config string empty",
+			r:     configRequest(ConfigCommandSet, "bar"),
+			w:     reply(ConfigCommandSet, "bar"),
+			after: "bar",
+		},
+		{
+			desc:   "force set",
+			r:      configRequest(ConfigCommandForceSet, "bar"),
+			config: "foo",
+			w:      reply(ConfigCommandForceSet, "bar"),
+			after:  "bar",
+		},
+		{
+			desc:   "unknown command",
+			r:      configRequest(0xf, ""),
+			config: "foo",
+			w: &Header{
+				Error: ErrorBadArgumentParameter,
+			},
+			after: "foo",
+		},
+	}
+
+	for i, tt := range tests {
+		target := &Target{
+			BufferCount:     16,
+			FirmwareVersion: 1,
+			SectorCount:     2,
+		}
+		if err := target.SetConfig([]byte(tt.config)); err != nil {
+			t.Fatalf("[%02d] test %q, failed to set config: %v", i, tt.desc, err)
+		}
+
+		w := &captureHeaderResponseSender{}
+		if _, err := ServeConfig(w, &Request{Header: tt.r}, target); err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.w, w.h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+
+		if want, got := []byte(tt.after), target.Config(); !bytes.Equal(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected config string:\n- want: %q\n-  got: %q",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+// configRequest creates a Query Config Information request Header with the
+// specified ConfigCommand and config string.
+func configRequest(c ConfigCommand, s string) *Header {
+	return &Header{
+		Command: CommandQueryConfigInformation,
+		Arg: &ConfigArg{
+			Command:      c,
+			StringLength: uint16(len(s)),
+			String:       []byte(s),
+		},
+	}
+}
@@ -0,0 +1,398 @@
+package aoe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// openPathWait is the amount of time OpenDevice waits for additional
+// responses after the first, to discover other paths to a target.
+const openPathWait = 10 * time.Millisecond
+
+var (
+	// ErrUnalignedWrite is returned by Device.WriteAt when the offset or
+	// length of a write is not a multiple of the AoE sector size (512 bytes).
+	ErrUnalignedWrite = errors.New("write offset and length must be multiples of 512 bytes")
+
+	// Compile-time interface checks
+	_ io.ReaderAt = &Device{}
+	_ io.WriterAt = &Device{}
+	_ Sizer       = &Device{}
+)
+
+// An ATAError is returned when an ATA command issued by a Device reports
+// an error status.
+type ATAError struct {
+	// Status and ErrFeature are the ATA status and error register values
+	// reported by the target.
+	Status     ATACmdStatus
+	ErrFeature uint8
+}
+
+// Error returns the string representation of an ATAError.
+func (e *ATAError) Error() string {
+	return fmt.Sprintf("ATA command failed: status 0x%02x, error 0x%02x",
+		uint8(e.Status), e.ErrFeature)
+}
+
+// A Device is a remote AoE target, accessed by issuing ATA commands using a
+// Client.  Device implements io.ReaderAt, io.WriterAt, and Sizer, so that AoE
+// targets can be accessed from Go code without the kernel AoE driver.
+//
+// A Device is safe for concurrent use.
+type Device struct {
+	// Major and Minor specify the address of the target.
+	Major uint16
+	Minor uint8
+
+	// HardwareAddr specifies the hardware address of the first server which
+	// responded on behalf of the target.  ATA commands may be issued to any
+	// server which responded on behalf of the target.
+	HardwareAddr net.HardwareAddr
+
+	c *Client
+
+	// sectors is the maximum number of sectors in a single ATA command,
+	// and buffers is the maximum number of outstanding commands.
+	sectors int
+	buffers int
+}
+
+// OpenDevice opens the AoE target with the specified Major and Minor
+// address.  OpenDevice issues a ConfigCommandRead request to the target, to
+// determine which servers serve it, and the maximum number of sectors and
+// outstanding commands it can handle.
+//
+// After the first response arrives, OpenDevice waits briefly for responses
+// from other servers and Conns, and remembers each as a path to the target.
+// ATA commands issued by the Device are distributed across all paths.
+func (c *Client) OpenDevice(ctx context.Context, major uint16, minor uint8) (*Device, error) {
+	if major == BroadcastMajor || minor == BroadcastMinor {
+		return nil, ErrInvalidTargetAddress
+	}
+
+	h := &Header{
+		Major:   major,
+		Minor:   minor,
+		Command: CommandQueryConfigInformation,
+		Arg: &ConfigArg{
+			Command: ConfigCommandRead,
+		},
+	}
+
+	// Stop collecting responses shortly after the first arrives
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		d    *Device
+		rerr error
+	)
+	err := c.roundTrip(pctx, nil, h, discoverBufferLen, func(r *reply) bool {
+		if r.h.FlagError {
+			rerr = r.h.Error
+			return d != nil
+		}
+
+		arg, ok := r.h.Arg.(*ConfigArg)
+		if !ok {
+			rerr = ErrorBadArgumentParameter
+			return d != nil
+		}
+
+		c.addPath(major, minor, r.conn, r.src, true, bufferCount(arg))
+		if d == nil {
+			d = c.newDevice(major, minor, r.src, arg)
+			time.AfterFunc(openPathWait, cancel)
+		}
+
+		return true
+	})
+	if d != nil {
+		return d, nil
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	return nil, err
+}
+
+// bufferCount returns the number of outstanding commands advertised in arg.
+func bufferCount(arg *ConfigArg) int {
+	if arg.BufferCount == 0 {
+		return 1
+	}
+
+	return int(arg.BufferCount)
+}
+
+// newDevice creates a Device using the settings advertised in a ConfigArg.
+func (c *Client) newDevice(major uint16, minor uint8, mac net.HardwareAddr, arg *ConfigArg) *Device {
+	// A sector count of 0 is equivalent to 2, per AoEr11, Section 3.2
+	sectors := int(arg.SectorCount)
+	if sectors == 0 {
+		sectors = 2
+	}
+
+	buffers := bufferCount(arg)
+	return &Device{
+		Major:        major,
+		Minor:        minor,
+		HardwareAddr: mac,
+
+		c:       c,
+		sectors: sectors,
+		buffers: buffers,
+	}
+}
+
+// Size implements Sizer.  Size issues an ATA IDENTIFY DEVICE command to the
+// target, and returns the capacity it reports in bytes.
+func (d *Device) Size() (int64, error) {
+	arg, err := d.ata(&ATAArg{
+		CmdStatus:   ATACmdStatusIdentify,
+		SectorCount: 1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(arg.Data) < sectorSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	return identifyCapacity(arg.Data), nil
+}
+
+// ReadAt reads len(p) bytes from the Device starting at byte offset off.
+// The read is split into ATA read commands of at most the target's
+// advertised SectorCount, which are issued concurrently.
+//
+// If the read extends beyond the end of the Device, as reported by Size,
+// the bytes up to the end of the Device are read, and io.EOF is returned.
+//
+// Each ATA command is subject to the Client's Timeout.
+func (d *Device) ReadAt(p []byte, off int64) (int, error) {
+	n, err := d.readAt(p, off)
+	if _, ok := err.(*ATAError); !ok {
+		return n, err
+	}
+
+	// Targets reject commands which address sectors beyond their capacity,
+	// so check whether the read did, and if so, read only up to the end
+	size, serr := d.Size()
+	if serr != nil || off+int64(len(p)) <= size {
+		return n, err
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+
+	n, err = d.readAt(p[:size-off], off)
+	if err == nil {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// readAt implements ReadAt, without regard for the capacity of the Device.
+func (d *Device) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidATARequest
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	// Read all sectors which contain the requested range
+	start := off / sectorSize
+	end := (off + int64(len(p)) + sectorSize - 1) / sectorSize
+	b := make([]byte, (end-start)*sectorSize)
+
+	n, err := d.do(start, b, false)
+
+	// Report only bytes within the requested range
+	n -= int(off - start*sectorSize)
+	if n < 0 {
+		n = 0
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	copy(p, b[off-start*sectorSize:])
+
+	return n, err
+}
+
+// WriteAt writes len(p) bytes to the Device starting at byte offset off.
+// The write is split into ATA write commands of at most the target's
+// advertised SectorCount, which are issued concurrently.
+//
+// Both off and len(p) must be multiples of 512 bytes, or ErrUnalignedWrite
+// is returned.  Each ATA command is subject to the Client's Timeout.
+func (d *Device) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrInvalidATARequest
+	}
+	if off%sectorSize != 0 || len(p)%sectorSize != 0 {
+		return 0, ErrUnalignedWrite
+	}
+
+	return d.do(off/sectorSize, p, true)
+}
+
+// do performs reads or writes of whole sectors in b, beginning at logical
+// block address lba.  do returns the number of contiguous bytes, starting
+// from the beginning of b, which were transferred successfully.
+func (d *Device) do(lba int64, b []byte, write bool) (int, error) {
+	chunk := d.sectors * sectorSize
+	nChunks := (len(b) + chunk - 1) / chunk
+
+	// Issue up to d.buffers commands concurrently for each server
+	servers := d.c.servers(d.Major, d.Minor)
+	if servers == 0 {
+		servers = 1
+	}
+
+	errs := make([]error, nChunks)
+	sem := make(chan struct{}, d.buffers*servers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < nChunks; i++ {
+		bi := b[i*chunk:]
+		if len(bi) > chunk {
+			bi = bi[:chunk]
+		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, bi []byte) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			errs[i] = d.command(lba+int64(i*d.sectors), bi, write)
+		}(i, bi)
+	}
+	wg.Wait()
+
+	// Report progress up to the first failed command
+	for i, err := range errs {
+		if err != nil {
+			return i * chunk, err
+		}
+	}
+
+	return len(b), nil
+}
+
+// command issues a single 48-bit ATA read or write command for the sectors
+// in b, beginning at logical block address lba.
+func (d *Device) command(lba int64, b []byte, write bool) error {
+	arg := &ATAArg{
+		FlagLBA48Extended: true,
+		SectorCount:       uint8(len(b) / sectorSize),
+		CmdStatus:         ATACmdStatusRead48Bit,
+		LBA:               lbaBytes(lba),
+	}
+	if write {
+		arg.FlagWrite = true
+		arg.CmdStatus = ATACmdStatusWrite48Bit
+		arg.Data = b
+	}
+
+	rarg, err := d.ata(arg)
+	if err != nil {
+		return err
+	}
+
+	if write {
+		return nil
+	}
+
+	if len(rarg.Data) < len(b) {
+		return io.ErrUnexpectedEOF
+	}
+	copy(b, rarg.Data)
+
+	return nil
+}
+
+// ata issues a single ATA command with argument arg, and returns the
+// argument of the response.  If the target reports an error, an *ATAError
+// is returned.
+func (d *Device) ata(arg *ATAArg) (*ATAArg, error) {
+	h := &Header{
+		Major:   d.Major,
+		Minor:   d.Minor,
+		Command: CommandIssueATACommand,
+		Arg:     arg,
+	}
+
+	// Distribute commands across all known paths to the target
+	var res *Header
+	err := d.c.exchange(context.Background(), d.c.paths(d.Major, d.Minor), h, 1, func(r *reply) bool {
+		res = r.h
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.FlagError {
+		return nil, res.Error
+	}
+
+	rarg, ok := res.Arg.(*ATAArg)
+	if !ok {
+		return nil, ErrorBadArgumentParameter
+	}
+	if rarg.CmdStatus&ATACmdStatusErrStatus != 0 {
+		return nil, &ATAError{
+			Status:     rarg.CmdStatus,
+			ErrFeature: rarg.ErrFeature,
+		}
+	}
+
+	return rarg, nil
+}
+
+// identifyCapacity returns the capacity in bytes reported by the ATA device
+// identification data in b, which must be at least 512 bytes in length.
+func identifyCapacity(b []byte) int64 {
+	word := func(w int) uint64 {
+		return uint64(binary.LittleEndian.Uint16(b[w*2:]))
+	}
+
+	// Prefer the 48-bit LBA capacity, if 48-bit LBA is supported
+	sectors := word(60) | word(61)<<16
+	if word(83)&0x0400 != 0 {
+		sectors = word(100) | word(101)<<16 | word(102)<<32 | word(103)<<48
+	}
+
+	// Logical sector size in words, if not the default of 512 bytes
+	logical := uint64(sectorSize)
+	if w := word(106); w&0xc000 == 0x4000 && w&0x1000 != 0 {
+		logical = 2 * (word(117) | word(118)<<16)
+	}
+
+	return int64(sectors * logical)
+}
+
+// lbaBytes converts a logical block address into the LBA array format used
+// by an ATAArg.  It is the inverse of calculateLBA.
+func lbaBytes(lba int64) [6]uint8 {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(lba))
+
+	var l [6]uint8
+	copy(l[:], b[:6])
+	return l
+}
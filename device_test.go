@@ -0,0 +1,258 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"testing"
+)
+
+func TestDeviceReadAtWriteAt(t *testing.T) {
+	// Target advertises 3 sectors per command, and up to 4 outstanding
+	// commands
+	target := &Target{
+		Major:       1,
+		Minor:       2,
+		BufferCount: 4,
+		SectorCount: 3,
+	}
+
+	disk := &memDisk{b: make([]byte, 64*sectorSize)}
+	mux := NewTargetServeMux()
+	mux.Handle(CommandIssueATACommand, disk)
+
+	c, done := testClientServer(t, mux, target)
+	defer done()
+
+	d, err := c.OpenDevice(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatalf("failed to open device: %v", err)
+	}
+	if want, got := serverMAC.String(), d.HardwareAddr.String(); want != got {
+		t.Fatalf("unexpected hardware address: %v != %v", want, got)
+	}
+
+	// Write 10 sectors, which requires 4 commands
+	p := make([]byte, 10*sectorSize)
+	for i := range p {
+		p[i] = byte(i / sectorSize)
+	}
+
+	n, err := d.WriteAt(p, 2*sectorSize)
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if want, got := len(p), n; want != got {
+		t.Fatalf("unexpected number of bytes written: %v != %v", want, got)
+	}
+	if want, got := p, disk.b[2*sectorSize:12*sectorSize]; !bytes.Equal(want, got) {
+		t.Fatal("unexpected data written to disk")
+	}
+	if want, got := 4, disk.commands(); want != got {
+		t.Fatalf("unexpected number of ATA commands: %v != %v", want, got)
+	}
+
+	// Read an unaligned range spanning several sectors
+	r := make([]byte, 3*sectorSize)
+	n, err = d.ReadAt(r, 3*sectorSize-10)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if want, got := len(r), n; want != got {
+		t.Fatalf("unexpected number of bytes read: %v != %v", want, got)
+	}
+	if want, got := disk.b[3*sectorSize-10:6*sectorSize-10], r; !bytes.Equal(want, got) {
+		t.Fatal("unexpected data read from disk")
+	}
+
+	if _, err := d.WriteAt(p[:10], 0); err != ErrUnalignedWrite {
+		t.Fatalf("unexpected error for unaligned write: %v", err)
+	}
+}
+
+func TestDeviceReadAtEOF(t *testing.T) {
+	target := &Target{
+		Major:       1,
+		Minor:       2,
+		SectorCount: 1,
+	}
+
+	disk := &memDisk{b: make([]byte, 2*sectorSize)}
+	mux := NewTargetServeMux()
+	mux.Handle(CommandIssueATACommand, disk)
+
+	c, done := testClientServer(t, mux, target)
+	defer done()
+
+	d, err := c.OpenDevice(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatalf("failed to open device: %v", err)
+	}
+
+	size, err := d.Size()
+	if err != nil {
+		t.Fatalf("failed to determine size: %v", err)
+	}
+	if want, got := int64(2*sectorSize), size; want != got {
+		t.Fatalf("unexpected size: %v != %v", want, got)
+	}
+
+	var tests = []struct {
+		desc string
+		n    int
+		off  int64
+		read int
+		err  error
+	}{
+		{
+			desc: "within device",
+			n:    sectorSize,
+			off:  sectorSize,
+			read: sectorSize,
+		},
+		{
+			desc: "beyond end of device",
+			n:    3 * sectorSize,
+			off:  10,
+			read: 2*sectorSize - 10,
+			err:  io.EOF,
+		},
+		{
+			desc: "at end of device",
+			n:    sectorSize,
+			off:  2 * sectorSize,
+			err:  io.EOF,
+		},
+	}
+
+	for i, tt := range tests {
+		n, err := d.ReadAt(make([]byte, tt.n), tt.off)
+		if want, got := tt.err, err; want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.read, n; want != got {
+			t.Fatalf("[%02d] test %q, unexpected number of bytes read: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_identifyCapacity(t *testing.T) {
+	var tests = []struct {
+		desc  string
+		words map[int]uint16
+		size  int64
+	}{
+		{
+			desc:  "28-bit LBA",
+			words: map[int]uint16{60: 100},
+			size:  100 * sectorSize,
+		},
+		{
+			desc: "48-bit LBA",
+			words: map[int]uint16{
+				60:  0xffff,
+				61:  0x0fff,
+				83:  0x0400,
+				102: 1,
+			},
+			size: (1 << 32) * sectorSize,
+		},
+		{
+			desc: "4096 byte logical sectors",
+			words: map[int]uint16{
+				60:  10,
+				106: 0x5000,
+				117: 2048,
+			},
+			size: 10 * 4096,
+		},
+	}
+
+	for i, tt := range tests {
+		b := make([]byte, sectorSize)
+		for w, v := range tt.words {
+			binary.LittleEndian.PutUint16(b[w*2:], v)
+		}
+
+		if want, got := tt.size, identifyCapacity(b); want != got {
+			t.Fatalf("[%02d] test %q, unexpected capacity: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_lbaBytes(t *testing.T) {
+	for _, lba := range []int64{0, 1, 0x0fffffff, 0x123456789abc} {
+		if want, got := lba, calculateLBA(lbaBytes(lba), true); want != got {
+			t.Fatalf("unexpected LBA: %v != %v", want, got)
+		}
+	}
+}
+
+// memDisk is a Handler which serves 48-bit ATA reads and writes, and
+// minimal ATA identification data, using an in-memory byte slice.  memDisk
+// is safe for concurrent use.
+type memDisk struct {
+	mu sync.Mutex
+	b  []byte
+	n  int
+}
+
+func (d *memDisk) ServeAoE(w ResponseSender, r *Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.n++
+
+	arg := r.Arg.(*ATAArg)
+	if arg.CmdStatus == ATACmdStatusIdentify {
+		id := make([]byte, sectorSize)
+		binary.LittleEndian.PutUint32(id[60*2:], uint32(len(d.b)/sectorSize))
+
+		_, _ = w.Send(&Header{
+			Arg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				Data:      id,
+			},
+		})
+		return
+	}
+
+	off := calculateLBA(arg.LBA, arg.FlagLBA48Extended) * sectorSize
+	end := off + int64(arg.SectorCount)*sectorSize
+
+	if end > int64(len(d.b)) {
+		_, _ = w.Send(&Header{
+			Arg: &ATAArg{
+				CmdStatus:  ATACmdStatusErrStatus,
+				ErrFeature: ATAErrAbort,
+			},
+		})
+		return
+	}
+
+	warg := &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}
+	if arg.FlagWrite {
+		copy(d.b[off:end], arg.Data)
+	} else {
+		warg.Data = make([]byte, end-off)
+		copy(warg.Data, d.b[off:end])
+	}
+
+	_, _ = w.Send(&Header{
+		Arg: warg,
+	})
+}
+
+// commands returns the number of ATA commands served by d.
+func (d *memDisk) commands() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.n
+}
@@ -0,0 +1,107 @@
+package aoe
+
+import "encoding/binary"
+
+const (
+	// dsmTRIM is the bit in the Features register of a DATA SET MANAGEMENT
+	// command which requests that LBA ranges be trimmed.
+	dsmTRIM = 0x01
+
+	// dsmMaxBlocks is the maximum number of 512 byte blocks of LBA range
+	// entries accepted in a single DATA SET MANAGEMENT command, reported in
+	// word 105 of the identification data.
+	dsmMaxBlocks = 1
+)
+
+// A Discarder is an object which can discard ranges of its data, such as
+// by deallocating them from an underlying file.  Discarded data may read
+// back as zeros, or may retain its previous contents.
+//
+// If the store passed to ServeATA or ServeATAAt implements Discarder, TRIM
+// support is reported to clients, and LBA ranges trimmed by clients are
+// passed to Discard.  On Linux, *os.File stores are discarded by punching
+// holes using fallocate, even though *os.File does not implement
+// Discarder.
+type Discarder interface {
+	Discard(off, n int64) error
+}
+
+// discarder returns a Discarder for the store, if the store implements
+// Discarder or can be discarded using a platform-specific mechanism.
+func (s *ataStore) discarder() (Discarder, bool) {
+	if d, ok := s.v.(Discarder); ok {
+		return d, true
+	}
+
+	return platformDiscarder(s.v)
+}
+
+// ataDataSetManagement performs an ATA DATA SET MANAGEMENT request on s
+// using the argument values in r.  Only TRIM is supported.  Each LBA range
+// entry in r.Data must lie within the capacity of s, or of t if it
+// specifies a fixed size, as described in ACS-2, Section 7.10.
+func ataDataSetManagement(r *ATAArg, s *ataStore, t *Target) (*ATAArg, error) {
+	// Only ATA DATA SET MANAGEMENT allowed here
+	if r.CmdStatus != ATACmdStatusDataSetManagement {
+		return nil, errATAAbort
+	}
+
+	// LBA range entries are sent by the client, so the request must be
+	// flagged as a write, and only TRIM is supported
+	if !r.FlagWrite || r.ErrFeature&dsmTRIM == 0 {
+		return nil, errATAAbort
+	}
+
+	// Verify that request data and block count match up, and that no more
+	// blocks are sent than are reported in the identification data
+	if r.SectorCount == 0 || r.SectorCount > dsmMaxBlocks || len(r.Data) != int(r.SectorCount)*sectorSize {
+		return nil, errATAAbort
+	}
+
+	// A store which cannot be discarded cannot be trimmed
+	d, ok := s.discarder()
+	if !ok {
+		return nil, errATAAbort
+	}
+
+	size, err := ataCapacity(s, t)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate all range entries before discarding any of them.  Each
+	// entry is a 48-bit LBA, followed by a 16-bit sector count.  Entries
+	// with a sector count of zero are unused.
+	type lbaRange struct {
+		lba, n int64
+	}
+
+	ranges := make([]lbaRange, 0, len(r.Data)/8)
+	for i := 0; i < len(r.Data); i += 8 {
+		e := binary.LittleEndian.Uint64(r.Data[i : i+8])
+
+		rr := lbaRange{
+			lba: int64(e & maxLBA48),
+			n:   int64(e >> 48),
+		}
+		if rr.n == 0 {
+			continue
+		}
+
+		if rr.lba+rr.n > size/sectorSize {
+			return nil, errATAAbort
+		}
+
+		ranges = append(ranges, rr)
+	}
+
+	for _, rr := range ranges {
+		if err := d.Discard(rr.lba*sectorSize, rr.n*sectorSize); err != nil {
+			return nil, errATAAbort
+		}
+	}
+
+	return &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}, nil
+}
@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package aoe
+
+import (
+	"os"
+	"syscall"
+)
+
+// Flags for fallocate, from <linux/falloc.h>.
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+)
+
+// platformDiscarder returns a Discarder which punches holes in v, if v is
+// an *os.File.
+func platformDiscarder(v interface{}) (Discarder, bool) {
+	f, ok := v.(*os.File)
+	if !ok {
+		return nil, false
+	}
+
+	return &fileDiscarder{f: f}, true
+}
+
+// A fileDiscarder is a Discarder which deallocates ranges of a file by
+// punching holes in it.  The size of the file is not changed, and
+// discarded ranges read back as zeros.
+type fileDiscarder struct {
+	f *os.File
+}
+
+// Discard implements Discarder.
+func (d *fileDiscarder) Discard(off, n int64) error {
+	err := syscall.Fallocate(int(d.f.Fd()), fallocPunchHole|fallocKeepSize, off, n)
+	if err != nil {
+		return &os.PathError{
+			Op:   "fallocate",
+			Path: d.f.Name(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
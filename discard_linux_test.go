@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package aoe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func Test_fileDiscarder(t *testing.T) {
+	f, err := ioutil.TempFile("", "aoe")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	const size = 1 << 20
+	if _, err := f.Write(bytes.Repeat([]byte{0xff}, size)); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	d, ok := newATAStore(f).discarder()
+	if !ok {
+		t.Fatal("*os.File should be discardable")
+	}
+
+	if err := d.Discard(0, size/2); err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.EOPNOTSUPP {
+			t.Skipf("skipping, file system does not support hole punching: %v", err)
+		}
+
+		t.Fatalf("failed to discard: %v", err)
+	}
+
+	// Size is unchanged, but the discarded range reads back as zeros
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatalf("failed to stat file: %v", err)
+	}
+	if want, got := int64(size), fi.Size(); want != got {
+		t.Fatalf("unexpected file size: %v != %v", want, got)
+	}
+
+	b := make([]byte, size)
+	if _, err := f.ReadAt(b, 0); err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	if want, got := make([]byte, size/2), b[:size/2]; !bytes.Equal(want, got) {
+		t.Fatal("discarded range was not zeroed")
+	}
+	if want, got := bytes.Repeat([]byte{0xff}, size/2), b[size/2:]; !bytes.Equal(want, got) {
+		t.Fatal("data outside discarded range was modified")
+	}
+}
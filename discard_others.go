@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package aoe
+
+// platformDiscarder reports that stores cannot be discarded, unless they
+// implement Discarder.
+func platformDiscarder(v interface{}) (Discarder, bool) {
+	return nil, false
+}
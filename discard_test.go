@@ -0,0 +1,216 @@
+package aoe
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func Test_ataDataSetManagement(t *testing.T) {
+	// Error returned by rangeDiscarder for error handling tests
+	errFoo := errors.New("foo")
+
+	// ranges builds a block of LBA range entries from pairs of LBA and
+	// sector count values
+	ranges := func(vs ...uint64) []byte {
+		b := make([]byte, sectorSize)
+		for i := 0; i < len(vs); i += 2 {
+			binary.LittleEndian.PutUint64(b[i*4:], vs[i]|vs[i+1]<<48)
+		}
+		return b
+	}
+
+	ok := &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}
+
+	var tests = []struct {
+		desc      string
+		rarg      *ATAArg
+		rs        io.ReadSeeker
+		t         *Target
+		warg      *ATAArg
+		discarded [][2]int64
+		err       error
+	}{
+		{
+			desc: "non-ATA data set management command",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusIdentify,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "not flagged as write",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: 1,
+				Data:        ranges(),
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "not TRIM",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				SectorCount: 1,
+				Data:        ranges(),
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "data and block count mismatch",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: 2,
+				Data:        ranges(),
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "too many blocks",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: dsmMaxBlocks + 1,
+				Data:        append(ranges(0, 1), make([]byte, dsmMaxBlocks*sectorSize)...),
+			},
+			rs:  &rangeDiscarder{},
+			t:   &Target{Size: 8 * sectorSize},
+			err: errATAAbort,
+		},
+		{
+			desc: "not Discarder",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: 1,
+				Data:        ranges(0, 1),
+			},
+			rs:  &noopReadWriteSeeker{},
+			err: errATAAbort,
+		},
+		{
+			desc: "range beyond capacity",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: 1,
+				Data:        ranges(0, 1, 7, 2),
+			},
+			rs:  &rangeDiscarder{},
+			t:   &Target{Size: 8 * sectorSize},
+			err: errATAAbort,
+		},
+		{
+			desc: "discard error",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: 1,
+				Data:        ranges(0, 1),
+			},
+			rs:        &rangeDiscarder{err: errFoo},
+			t:         &Target{Size: 8 * sectorSize},
+			discarded: [][2]int64{{0, sectorSize}},
+			err:       errATAAbort,
+		},
+		{
+			desc: "TRIM OK",
+			rarg: &ATAArg{
+				FlagWrite:   true,
+				CmdStatus:   ATACmdStatusDataSetManagement,
+				ErrFeature:  dsmTRIM,
+				SectorCount: 1,
+				Data:        ranges(1, 2, 0, 0, 6, 2),
+			},
+			rs:   &rangeDiscarder{},
+			t:    &Target{Size: 8 * sectorSize},
+			warg: ok,
+			discarded: [][2]int64{
+				{1 * sectorSize, 2 * sectorSize},
+				{6 * sectorSize, 2 * sectorSize},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		warg, err := ataDataSetManagement(tt.rarg, newATAStore(tt.rs), tt.t)
+
+		if d, ok := tt.rs.(*rangeDiscarder); ok {
+			if want, got := tt.discarded, d.ranges; !reflect.DeepEqual(want, got) {
+				t.Fatalf("[%02d] test %q, unexpected discarded ranges:\n- want: %v\n-  got: %v",
+					i, tt.desc, want, got)
+			}
+		}
+
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.warg, warg; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_identifyTRIM(t *testing.T) {
+	var tests = []struct {
+		desc string
+		trim bool
+		w105 uint16
+		w169 uint16
+	}{
+		{
+			desc: "TRIM not supported",
+		},
+		{
+			desc: "TRIM supported",
+			trim: true,
+			w105: dsmMaxBlocks,
+			w169: 0x0001,
+		},
+	}
+
+	for i, tt := range tests {
+		id := identify(64, nil, ataFeatures{}, tt.trim)
+
+		if want, got := tt.w105, binary.LittleEndian.Uint16(id[105*2:]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected maximum range blocks: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.w169, binary.LittleEndian.Uint16(id[169*2:]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected data set management support: %#04x != %#04x",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+// rangeDiscarder is a Discarder which records each range it discards, and
+// returns its err field.
+type rangeDiscarder struct {
+	noopReadWriteSeeker
+	ranges [][2]int64
+	err    error
+}
+
+func (d *rangeDiscarder) Discard(off, n int64) error {
+	d.ranges = append(d.ranges, [2]int64{off, n})
+	return d.err
+}
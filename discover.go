@@ -0,0 +1,123 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// defaultDiscoverTimeout is the amount of time Discover waits for
+	// responses, if no other timeout is specified.
+	defaultDiscoverTimeout = 1 * time.Second
+
+	// discoverBufferLen is the number of responses to a discovery request
+	// which may be queued before responses are dropped.
+	discoverBufferLen = 256
+)
+
+// A DiscoveredTarget is an AoE target which responded to a discovery request
+// issued by Client.Discover.
+type DiscoveredTarget struct {
+	// HardwareAddr specifies the hardware address of the server which
+	// responded on behalf of the target.
+	HardwareAddr net.HardwareAddr
+
+	// Major and Minor specify the address of the target.
+	Major uint16
+	Minor uint8
+
+	// Config specifies the target's config string.
+	Config []byte
+
+	// BufferCount specifies the maximum number of outstanding messages the
+	// target can queue for processing.
+	BufferCount uint16
+
+	// SectorCount specifies the maximum number of sectors the target can
+	// handle in a single ATA command request.  A value of 0 is equivalent
+	// to 2.
+	SectorCount uint8
+
+	// FirmwareVersion specifies the firmware version of the target.
+	FirmwareVersion uint16
+
+	// Version specifies the AoE protocol version supported by the target.
+	Version uint8
+}
+
+// Discover broadcasts a ConfigCommandRead request to BroadcastMajor and
+// BroadcastMinor, and collects each response into a DiscoveredTarget.
+// Targets which respond from multiple hardware addresses appear once for
+// each address.  Targets are ordered by Major, Minor, and then hardware
+// address.
+//
+// Each responding server is remembered as a path to its target, using the
+// Conn on which the response arrived.
+//
+// Discover collects responses until c.Timeout or a deadline set on ctx
+// expires.  If neither is set, responses are collected for one second.  If
+// ctx is otherwise canceled, ctx.Err() is returned.
+func (c *Client) Discover(ctx context.Context) ([]*DiscoveredTarget, error) {
+	if _, ok := ctx.Deadline(); !ok && c.Timeout == 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultDiscoverTimeout)
+		defer cancel()
+	}
+
+	h := &Header{
+		Major:   BroadcastMajor,
+		Minor:   BroadcastMinor,
+		Command: CommandQueryConfigInformation,
+		Arg: &ConfigArg{
+			Command: ConfigCommandRead,
+		},
+	}
+
+	var ts []*DiscoveredTarget
+	err := c.roundTrip(ctx, nil, h, discoverBufferLen, func(r *reply) bool {
+		arg, ok := r.h.Arg.(*ConfigArg)
+		if !ok || r.h.FlagError {
+			return true
+		}
+
+		c.addPath(r.h.Major, r.h.Minor, r.conn, r.src, false, 0)
+
+		ts = append(ts, &DiscoveredTarget{
+			HardwareAddr:    r.src,
+			Major:           r.h.Major,
+			Minor:           r.h.Minor,
+			Config:          arg.String,
+			BufferCount:     arg.BufferCount,
+			SectorCount:     arg.SectorCount,
+			FirmwareVersion: arg.FirmwareVersion,
+			Version:         arg.Version,
+		})
+		return true
+	})
+	if err != nil && err != ErrNoResponse {
+		return nil, err
+	}
+
+	sort.Sort(byDiscovered(ts))
+	return ts, nil
+}
+
+// byDiscovered sorts DiscoveredTargets by Major, Minor, and then hardware
+// address.
+type byDiscovered []*DiscoveredTarget
+
+func (b byDiscovered) Len() int      { return len(b) }
+func (b byDiscovered) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byDiscovered) Less(i, j int) bool {
+	if b[i].Major != b[j].Major {
+		return b[i].Major < b[j].Major
+	}
+	if b[i].Minor != b[j].Minor {
+		return b[i].Minor < b[j].Minor
+	}
+
+	return bytes.Compare(b[i].HardwareAddr, b[j].HardwareAddr) < 0
+}
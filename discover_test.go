@@ -0,0 +1,69 @@
+package aoe
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestClientDiscover(t *testing.T) {
+	targets := []*Target{
+		{Major: 2, Minor: 1, BufferCount: 8, SectorCount: 2},
+		{Major: 1, Minor: 2, BufferCount: 16, SectorCount: 17, FirmwareVersion: 3},
+	}
+	for i, target := range targets {
+		if err := target.SetConfig([]byte{'a' + byte(i)}); err != nil {
+			t.Fatalf("failed to set config: %v", err)
+		}
+	}
+
+	c, done := testClientServer(t, nil, targets...)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	ts, err := c.Discover(ctx)
+	if err != nil {
+		t.Fatalf("failed to discover targets: %v", err)
+	}
+
+	want := []*DiscoveredTarget{
+		{
+			HardwareAddr:    serverMAC,
+			Major:           1,
+			Minor:           2,
+			Config:          []byte("b"),
+			BufferCount:     16,
+			SectorCount:     17,
+			FirmwareVersion: 3,
+			Version:         Version,
+		},
+		{
+			HardwareAddr: serverMAC,
+			Major:        2,
+			Minor:        1,
+			Config:       []byte("a"),
+			BufferCount:  8,
+			SectorCount:  2,
+			Version:      Version,
+		},
+	}
+
+	if got := ts; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected targets:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+func TestClientDiscoverCanceled(t *testing.T) {
+	c, done := testClientServer(t, nil)
+	defer done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := c.Discover(ctx); err != context.Canceled {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
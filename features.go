@@ -0,0 +1,60 @@
+package aoe
+
+// SET FEATURES subcommands, specified in the Features register of an ATA
+// SET FEATURES command, as described in ATA8-ACS, Section 7.48.
+const (
+	featureEnableWriteCache  = 0x02
+	featureDisableWriteCache = 0x82
+	featureEnableReadAhead   = 0xaa
+	featureDisableReadAhead  = 0x55
+)
+
+// ataFeatures is the state of ATA device features which clients may enable
+// or disable.  The zero value enables all features.
+type ataFeatures struct {
+	smartDisabled      bool
+	writeCacheDisabled bool
+	readAheadDisabled  bool
+}
+
+// ataSetFeatures performs an ATA SET FEATURES request using the argument
+// values in r, updating the state of Target t.  The subcommand is specified
+// by r.ErrFeature.  Only the volatile write cache and read look-ahead
+// features may be changed.
+//
+// If t is nil, feature state cannot be kept, so only requests which leave
+// all features enabled succeed.
+func ataSetFeatures(r *ATAArg, t *Target) (*ATAArg, error) {
+	// Only ATA SET FEATURES allowed here
+	if r.CmdStatus != ATACmdStatusSetFeatures {
+		return nil, errATAAbort
+	}
+
+	var set func(f *ataFeatures)
+	switch r.ErrFeature {
+	case featureEnableWriteCache, featureDisableWriteCache:
+		set = func(f *ataFeatures) {
+			f.writeCacheDisabled = r.ErrFeature == featureDisableWriteCache
+		}
+	case featureEnableReadAhead, featureDisableReadAhead:
+		set = func(f *ataFeatures) {
+			f.readAheadDisabled = r.ErrFeature == featureDisableReadAhead
+		}
+	default:
+		return nil, errATAAbort
+	}
+
+	if t == nil {
+		var f ataFeatures
+		set(&f)
+		if f != (ataFeatures{}) {
+			return nil, errATAAbort
+		}
+	}
+
+	t.updateATAFeatures(set)
+
+	return &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}, nil
+}
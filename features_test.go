@@ -0,0 +1,239 @@
+package aoe
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func Test_ataSetFeatures(t *testing.T) {
+	ok := &ATAArg{
+		CmdStatus: ATACmdStatusReadyStatus,
+	}
+
+	var tests = []struct {
+		desc string
+		rarg *ATAArg
+		t    *Target
+		warg *ATAArg
+		f    ataFeatures
+		err  error
+	}{
+		{
+			desc: "non-ATA set features command",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusIdentify,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "unknown subcommand",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: 0x03,
+			},
+			t:   &Target{},
+			err: errATAAbort,
+		},
+		{
+			desc: "disable write cache without Target",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: featureDisableWriteCache,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "enable write cache without Target",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: featureEnableWriteCache,
+			},
+			warg: ok,
+		},
+		{
+			desc: "disable write cache",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: featureDisableWriteCache,
+			},
+			t:    &Target{},
+			warg: ok,
+			f:    ataFeatures{writeCacheDisabled: true},
+		},
+		{
+			desc: "enable write cache",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: featureEnableWriteCache,
+			},
+			t: &Target{
+				features: ataFeatures{
+					writeCacheDisabled: true,
+					readAheadDisabled:  true,
+				},
+			},
+			warg: ok,
+			f:    ataFeatures{readAheadDisabled: true},
+		},
+		{
+			desc: "disable read look-ahead",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: featureDisableReadAhead,
+			},
+			t:    &Target{},
+			warg: ok,
+			f:    ataFeatures{readAheadDisabled: true},
+		},
+		{
+			desc: "enable read look-ahead",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSetFeatures,
+				ErrFeature: featureEnableReadAhead,
+			},
+			t: &Target{
+				features: ataFeatures{readAheadDisabled: true},
+			},
+			warg: ok,
+		},
+	}
+
+	for i, tt := range tests {
+		warg, err := ataSetFeatures(tt.rarg, tt.t)
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.warg, warg; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+
+		if want, got := tt.f, tt.t.ataFeatures(); want != got {
+			t.Fatalf("[%02d] test %q, unexpected features:\n- want: %+v\n-  got: %+v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_identifyFeatures(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		f       ataFeatures
+		enabled uint16
+	}{
+		{
+			desc:    "all features enabled",
+			enabled: 0x4061,
+		},
+		{
+			desc:    "write cache disabled",
+			f:       ataFeatures{writeCacheDisabled: true},
+			enabled: 0x4041,
+		},
+		{
+			desc:    "read look-ahead disabled",
+			f:       ataFeatures{readAheadDisabled: true},
+			enabled: 0x4021,
+		},
+		{
+			desc: "all features disabled",
+			f: ataFeatures{
+				smartDisabled:      true,
+				writeCacheDisabled: true,
+				readAheadDisabled:  true,
+			},
+			enabled: 0x4000,
+		},
+	}
+
+	for i, tt := range tests {
+		id := identify(64, nil, tt.f, false)
+
+		// Supported features never change
+		if want, got := uint16(0x4061), binary.LittleEndian.Uint16(id[82*2:]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected supported features: %#04x != %#04x",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.enabled, binary.LittleEndian.Uint16(id[85*2:]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected enabled features: %#04x != %#04x",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServeATAWriteCacheDisabled(t *testing.T) {
+	ms := newMemStore(sectorSize)
+	wb := NewWriteBack(ms, sectorSize)
+	defer wb.Close()
+
+	target := &Target{
+		Major: 1,
+		Minor: 1,
+		Store: wb,
+	}
+
+	serve := func(arg *ATAArg) *ATAArg {
+		w := &captureHeaderResponseSender{}
+		r := &Request{
+			Header: &Header{
+				Command: CommandIssueATACommand,
+				Arg:     arg,
+			},
+			Target: target,
+		}
+
+		if _, err := serveATA(w, r, target.ataStore()); err != nil {
+			t.Fatalf("failed to serve ATA request: %v", err)
+		}
+
+		return w.h.Arg.(*ATAArg)
+	}
+
+	write := func() {
+		arg := serve(&ATAArg{
+			FlagWrite:        true,
+			FlagAsynchronous: true,
+			CmdStatus:        ATACmdStatusWrite28Bit,
+			SectorCount:      1,
+			Data:             make([]byte, sectorSize),
+		})
+		if want, got := ATACmdStatusReadyStatus, arg.CmdStatus; want != got {
+			t.Fatalf("unexpected write status: %#02x != %#02x", want, got)
+		}
+	}
+
+	// With the write cache enabled, asynchronous writes are not synced
+	write()
+	if err := wb.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	if want, got := 0, ms.syncs(); want != got {
+		t.Fatalf("unexpected number of syncs with write cache enabled: %v != %v",
+			want, got)
+	}
+
+	arg := serve(&ATAArg{
+		CmdStatus:  ATACmdStatusSetFeatures,
+		ErrFeature: featureDisableWriteCache,
+	})
+	if want, got := ATACmdStatusReadyStatus, arg.CmdStatus; want != got {
+		t.Fatalf("unexpected set features status: %#02x != %#02x", want, got)
+	}
+
+	// With the write cache disabled, each write is synced before it is
+	// acknowledged
+	for i := 1; i <= 2; i++ {
+		write()
+		if want, got := i, ms.syncs(); want != got {
+			t.Fatalf("unexpected number of syncs with write cache disabled: %v != %v",
+				want, got)
+		}
+	}
+}
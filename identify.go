@@ -0,0 +1,337 @@
+package aoe
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// Default identification strings reported in generated ATA device
+	// identification data.
+	identifyModel    = "mdlayher/aoe"
+	identifySerial   = "AOE"
+	identifyFirmware = "AoEr11"
+
+	// Maximum number of sectors addressable using 28-bit and 48-bit LBA.
+	maxLBA28 = 1<<28 - 1
+	maxLBA48 = 1<<48 - 1
+
+	// Lengths of identification string fields, in bytes.
+	identifyModelLen    = 40
+	identifySerialLen   = 20
+	identifyFirmwareLen = 8
+)
+
+// ErrInvalidIdentity is returned when a Target with an invalid Identity is
+// added to a TargetRegistry.
+var ErrInvalidIdentity = errors.New("invalid identity")
+
+// An Identity specifies the ATA device identification data reported to
+// clients for a Target, when its Store does not implement Identifier.  The
+// zero value of each field selects a default.
+type Identity struct {
+	// Model, Serial, and FirmwareRevision specify the model number, serial
+	// number, and firmware revision strings reported to clients.  Each must
+	// consist of printable ASCII characters, and may be no longer than 40,
+	// 20, and 8 bytes, respectively.
+	//
+	// Clients commonly use the serial number to name devices, such as in
+	// udev rules, so it should be unique and stable for each Target.
+	Model            string
+	Serial           string
+	FirmwareRevision string
+
+	// WWN specifies the device's 64-bit World Wide Name.  If zero, no World
+	// Wide Name is reported.
+	WWN uint64
+
+	// LogicalSectorSize and PhysicalSectorSize specify the sector size hints
+	// reported to clients, in bytes.  LogicalSectorSize must be a multiple
+	// of 512 bytes, and PhysicalSectorSize must be a power of two multiple
+	// of LogicalSectorSize.  If zero, both default to 512 bytes.
+	//
+	// I/O on a Target's Store is aligned to PhysicalSectorSize, even if the
+	// Store implements Identifier, so that a Store opened with O_DIRECT on a
+	// device with 4096 byte sectors may set PhysicalSectorSize to 4096.
+	//
+	// AoE requests always address 512 byte sectors, and device capacity is
+	// reported in logical sectors, so most Targets should leave
+	// LogicalSectorSize unset.
+	LogicalSectorSize  int
+	PhysicalSectorSize int
+
+	// RotationRate specifies the nominal media rotation rate reported to
+	// clients, in revolutions per minute.  A value of 1 indicates a
+	// non-rotating device, such as a solid state drive.  Otherwise, the
+	// value must be between 1025 and 65534.  If zero, no rate is reported.
+	RotationRate uint16
+}
+
+// validate reports whether the Identity is valid.
+func (i *Identity) validate() bool {
+	if !isIdentifyString(i.Model, identifyModelLen) ||
+		!isIdentifyString(i.Serial, identifySerialLen) ||
+		!isIdentifyString(i.FirmwareRevision, identifyFirmwareLen) {
+		return false
+	}
+
+	logical, physical := i.sectorSizes()
+	if logical <= 0 || physical <= 0 {
+		return false
+	}
+	if logical%sectorSize != 0 || physical%logical != 0 {
+		return false
+	}
+	if n := physical / logical; n&(n-1) != 0 || n > 1<<15 {
+		return false
+	}
+
+	switch r := i.RotationRate; {
+	case r == 0, r == 1:
+	case r >= 0x0401 && r <= 0xfffe:
+	default:
+		return false
+	}
+
+	return true
+}
+
+// sectorSizes returns the Identity's logical and physical sector sizes,
+// applying defaults for unset values.
+func (i *Identity) sectorSizes() (logical int, physical int) {
+	logical, physical = sectorSize, i.PhysicalSectorSize
+	if i.LogicalSectorSize != 0 {
+		logical = i.LogicalSectorSize
+	}
+	if physical == 0 {
+		physical = logical
+	}
+
+	return logical, physical
+}
+
+// isIdentifyString reports whether s may be stored in an identification
+// string field of n bytes.
+func isIdentifyString(s string, n int) bool {
+	if len(s) > n {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// A Sizer is an object which can report its size in bytes.  If the store
+// passed to ServeATA or ServeATAAt implements Sizer, its size is used as the
+// capacity of the device.  Otherwise, the size is determined using a Stat
+// method, such as that of *os.File, or by seeking to the end of the store.
+type Sizer interface {
+	Size() (int64, error)
+}
+
+// identify generates ATA device identification data for a device with the
+// specified number of 512 byte sectors, in the same manner as vblade.  The
+// data is laid out as described in ATA8-ACS, Section 7.16.7.
+//
+// If ident is not nil, its fields override the default identification
+// data.  The enabled state of each optional feature set is reported using
+// f.  If trim is true, the TRIM bit of DATA SET MANAGEMENT is reported as
+// supported.
+func identify(sectors int64, ident *Identity, f ataFeatures, trim bool) [512]byte {
+	if ident == nil {
+		ident = &Identity{}
+	}
+
+	model, serial, firmware := identifyModel, identifySerial, identifyFirmware
+	if ident.Model != "" {
+		model = ident.Model
+	}
+	if ident.Serial != "" {
+		serial = ident.Serial
+	}
+	if ident.FirmwareRevision != "" {
+		firmware = ident.FirmwareRevision
+	}
+
+	// Capacity is reported in logical sectors
+	logical, physical := ident.sectorSizes()
+	sectors = sectors * sectorSize / int64(logical)
+
+	var id identifyData
+
+	// Fixed, non-removable device
+	id.setWord(0, 0x0040)
+
+	// Legacy CHS geometry, for clients which do not understand LBA
+	cyls := sectors / (16 * 63)
+	if cyls > 16383 {
+		cyls = 16383
+	}
+	id.setWord(1, uint16(cyls))
+	id.setWord(3, 16)
+	id.setWord(6, 63)
+
+	id.setString(10, identifySerialLen, serial)
+	id.setString(23, identifyFirmwareLen, firmware)
+	id.setString(27, identifyModelLen, model)
+
+	// READ/WRITE MULTIPLE is not supported
+	id.setWord(47, 0x8000)
+	// LBA supported
+	id.setWord(49, 0x0200)
+	id.setWord(50, 0x4000)
+	// Words 54-58, 64-70, and 88 are valid
+	id.setWord(53, 0x0007)
+
+	// Current CHS geometry and capacity
+	id.setWord(54, uint16(cyls))
+	id.setWord(55, 16)
+	id.setWord(56, 63)
+	id.setUint32(57, uint32(cyls*16*63))
+
+	// Total number of sectors addressable using 28-bit LBA
+	lba28 := sectors
+	if lba28 > maxLBA28 {
+		lba28 = maxLBA28
+	}
+	id.setUint32(60, uint32(lba28))
+
+	// ATA/ATAPI-4 through ATA8-ACS
+	id.setWord(80, 0x01f0)
+
+	// Supported command sets: SMART, volatile write cache, read look-ahead,
+	// NOP, 48-bit LBA, FLUSH CACHE, and FLUSH CACHE EXT, and optionally
+	// World Wide Name
+	var wwn uint16
+	if ident.WWN != 0 {
+		wwn = 0x0100
+	}
+
+	id.setWord(82, 0x4061)
+	id.setWord(83, 0x7400)
+	id.setWord(84, 0x4000|wwn)
+
+	// Enabled command sets
+	enabled := uint16(0x4000)
+	if !f.smartDisabled {
+		enabled |= 0x0001
+	}
+	if !f.writeCacheDisabled {
+		enabled |= 0x0020
+	}
+	if !f.readAheadDisabled {
+		enabled |= 0x0040
+	}
+
+	id.setWord(85, enabled)
+	id.setWord(86, 0x3400)
+	id.setWord(87, 0x4000|wwn)
+
+	// Total number of sectors addressable using 48-bit LBA
+	lba48 := sectors
+	if lba48 > maxLBA48 {
+		lba48 = maxLBA48
+	}
+	id.setUint64(100, uint64(lba48))
+
+	// Maximum number of 512 byte blocks of LBA range entries per DATA SET
+	// MANAGEMENT command
+	if trim {
+		id.setWord(105, dsmMaxBlocks)
+	}
+
+	// Logical and physical sector sizes, if not the default of 512 bytes
+	if logical != sectorSize || physical != logical {
+		w := uint16(0x4000)
+		if physical != logical {
+			// Multiple logical sectors per physical sector, as a power of
+			// two
+			w |= 0x2000
+			for n := physical / logical; n > 1; n >>= 1 {
+				w++
+			}
+		}
+		if logical != sectorSize {
+			// Logical sector size is specified in words 117-118, in words
+			w |= 0x1000
+			id.setUint32(117, uint32(logical/2))
+		}
+
+		id.setWord(106, w)
+
+		// Logical sector 0 is aligned to the start of a physical sector
+		if physical != logical {
+			id.setWord(209, 0x4000)
+		}
+	}
+
+	// World Wide Name, most significant word first
+	if ident.WWN != 0 {
+		for i := 0; i < 4; i++ {
+			id.setWord(108+i, uint16(ident.WWN>>uint(48-16*i)))
+		}
+	}
+
+	// DATA SET MANAGEMENT with the TRIM bit set is supported
+	if trim {
+		id.setWord(169, 0x0001)
+	}
+
+	// Nominal media rotation rate
+	id.setWord(217, ident.RotationRate)
+
+	id.checksum()
+	return [512]byte(id)
+}
+
+// identifyData is a 256 word block of ATA device identification data.
+type identifyData [512]byte
+
+// setWord sets word w to v.
+func (id *identifyData) setWord(w int, v uint16) {
+	binary.LittleEndian.PutUint16(id[w*2:], v)
+}
+
+// setUint32 sets the two words beginning at w to v, least significant word
+// first.
+func (id *identifyData) setUint32(w int, v uint32) {
+	binary.LittleEndian.PutUint32(id[w*2:], v)
+}
+
+// setUint64 sets the four words beginning at w to v, least significant word
+// first.
+func (id *identifyData) setUint64(w int, v uint64) {
+	binary.LittleEndian.PutUint64(id[w*2:], v)
+}
+
+// setString sets the n bytes beginning at word w to s, padded with spaces.
+// Per ATA8-ACS, Section 3.3.10, the first character of each pair is stored
+// in the most significant byte of each word.
+func (id *identifyData) setString(w int, n int, s string) {
+	b := id[w*2 : w*2+n]
+	for i := range b {
+		c := byte(' ')
+		if i < len(s) {
+			c = s[i]
+		}
+
+		b[i^1] = c
+	}
+}
+
+// checksum sets the integrity word (word 255), so that the sum of all
+// bytes in id is zero, as described in ATA8-ACS, Section 7.16.7.91.
+func (id *identifyData) checksum() {
+	id[510] = 0xa5
+
+	var sum byte
+	for _, b := range id[:511] {
+		sum += b
+	}
+	id[511] = -sum
+}
@@ -0,0 +1,227 @@
+package aoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_identify(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		sectors int64
+		lba28   uint32
+		lba48   uint64
+		cyls    uint16
+	}{
+		{
+			desc:    "empty device",
+			sectors: 0,
+		},
+		{
+			desc:    "small device",
+			sectors: 2048,
+			lba28:   2048,
+			lba48:   2048,
+			cyls:    2,
+		},
+		{
+			desc:    "device larger than 28-bit LBA",
+			sectors: 1 << 32,
+			lba28:   maxLBA28,
+			lba48:   1 << 32,
+			cyls:    16383,
+		},
+	}
+
+	for i, tt := range tests {
+		id := identify(tt.sectors, nil, ataFeatures{}, false)
+
+		word := func(w int) uint16 {
+			return binary.LittleEndian.Uint16(id[w*2:])
+		}
+
+		if want, got := tt.cyls, word(1); want != got {
+			t.Fatalf("[%02d] test %q, unexpected cylinders: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.lba28, binary.LittleEndian.Uint32(id[60*2:]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected 28-bit capacity: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.lba48, binary.LittleEndian.Uint64(id[100*2:]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected 48-bit capacity: %v != %v",
+				i, tt.desc, want, got)
+		}
+
+		// 48-bit LBA, FLUSH CACHE, and FLUSH CACHE EXT are supported
+		if want, got := uint16(0x7400), word(83); want != got {
+			t.Fatalf("[%02d] test %q, unexpected supported commands: %#04x != %#04x",
+				i, tt.desc, want, got)
+		}
+
+		if want, got := uint8(0xa5), id[510]; want != got {
+			t.Fatalf("[%02d] test %q, unexpected checksum signature: %#02x != %#02x",
+				i, tt.desc, want, got)
+		}
+
+		var sum byte
+		for _, b := range id {
+			sum += b
+		}
+		if sum != 0 {
+			t.Fatalf("[%02d] test %q, invalid checksum: %#02x",
+				i, tt.desc, sum)
+		}
+	}
+}
+
+func Test_identifyDataSetString(t *testing.T) {
+	var id identifyData
+	id.setString(27, 8, "abcde")
+
+	if want, got := []byte("badc e  "), id[54:62]; !bytes.Equal(want, got) {
+		t.Fatalf("unexpected string bytes: %q != %q", want, got)
+	}
+}
+
+// sizer is a Sizer which returns the value of its size field.
+type sizer struct {
+	noopReadWriteSeeker
+	size int64
+}
+
+func (s *sizer) Size() (int64, error) {
+	return s.size, nil
+}
+
+func Test_identifyIdentity(t *testing.T) {
+	id := identify(64, &Identity{
+		Model:              "model",
+		Serial:             "serial",
+		FirmwareRevision:   "fw",
+		WWN:                0x5000c50012345678,
+		PhysicalSectorSize: 4096,
+		RotationRate:       1,
+	}, ataFeatures{}, false)
+
+	word := func(w int) uint16 {
+		return binary.LittleEndian.Uint16(id[w*2:])
+	}
+
+	strs := []struct {
+		w, n int
+		s    string
+	}{
+		{w: 10, n: 20, s: "serial"},
+		{w: 23, n: 8, s: "fw"},
+		{w: 27, n: 40, s: "model"},
+	}
+	for _, s := range strs {
+		var want identifyData
+		want.setString(s.w, s.n, s.s)
+
+		b := want[s.w*2 : s.w*2+s.n]
+		if got := id[s.w*2 : s.w*2+s.n]; !bytes.Equal(b, got) {
+			t.Fatalf("unexpected string at word %d: %q != %q", s.w, b, got)
+		}
+	}
+
+	// 8 logical sectors per physical sector
+	if want, got := uint16(0x6003), word(106); want != got {
+		t.Fatalf("unexpected sector size word: %#04x != %#04x", want, got)
+	}
+
+	// Logical sector 0 is aligned with physical sector 0
+	if want, got := uint16(0x4000), word(209); want != got {
+		t.Fatalf("unexpected alignment word: %#04x != %#04x", want, got)
+	}
+
+	if want, got := uint16(0x4100), word(84); want != got {
+		t.Fatalf("unexpected WWN supported word: %#04x != %#04x", want, got)
+	}
+	for i, want := range []uint16{0x5000, 0xc500, 0x1234, 0x5678} {
+		if got := word(108 + i); want != got {
+			t.Fatalf("unexpected WWN word %d: %#04x != %#04x", 108+i, want, got)
+		}
+	}
+
+	if want, got := uint16(1), word(217); want != got {
+		t.Fatalf("unexpected rotation rate: %v != %v", want, got)
+	}
+
+	// Capacity is reported in logical sectors
+	id = identify(64, &Identity{LogicalSectorSize: 4096}, ataFeatures{}, false)
+	if want, got := uint64(8), binary.LittleEndian.Uint64(id[100*2:]); want != got {
+		t.Fatalf("unexpected 48-bit capacity: %v != %v", want, got)
+	}
+	if want, got := uint32(2048), binary.LittleEndian.Uint32(id[117*2:]); want != got {
+		t.Fatalf("unexpected logical sector size: %v != %v", want, got)
+	}
+}
+
+func TestIdentityValidate(t *testing.T) {
+	var tests = []struct {
+		desc string
+		i    *Identity
+		ok   bool
+	}{
+		{
+			desc: "zero value",
+			i:    &Identity{},
+			ok:   true,
+		},
+		{
+			desc: "serial too long",
+			i:    &Identity{Serial: "012345678901234567890"},
+		},
+		{
+			desc: "non-printable model",
+			i:    &Identity{Model: "foo\n"},
+		},
+		{
+			desc: "unaligned logical sector size",
+			i:    &Identity{LogicalSectorSize: 1000},
+		},
+		{
+			desc: "negative logical sector size",
+			i:    &Identity{LogicalSectorSize: -512},
+		},
+		{
+			desc: "negative physical sector size",
+			i:    &Identity{PhysicalSectorSize: -4096},
+		},
+		{
+			desc: "physical sector size not power of two multiple",
+			i:    &Identity{PhysicalSectorSize: 1536},
+		},
+		{
+			desc: "invalid rotation rate",
+			i:    &Identity{RotationRate: 2},
+		},
+		{
+			desc: "OK",
+			i: &Identity{
+				Model:              "foo",
+				Serial:             "bar",
+				FirmwareRevision:   "1.0",
+				PhysicalSectorSize: 4096,
+				RotationRate:       7200,
+			},
+			ok: true,
+		},
+	}
+
+	for i, tt := range tests {
+		if want, got := tt.ok, tt.i.validate(); want != got {
+			t.Fatalf("[%02d] test %q, unexpected validity: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+
+	tr := NewTargetRegistry()
+	err := tr.Add(&Target{Identity: &Identity{RotationRate: 2}})
+	if want, got := ErrInvalidIdentity, err; want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+}
@@ -0,0 +1,153 @@
+package aoe
+
+import (
+	"bytes"
+	"errors"
+	"net"
+)
+
+const (
+	// maxMACMaskLen is the maximum number of hardware addresses in a
+	// Target's MAC mask list.  As in vblade, this keeps replies to
+	// MACMaskCommandRead within a single standard Ethernet frame.
+	maxMACMaskLen = 32
+)
+
+var (
+	// ErrInvalidMACMaskRequest is returned when an invalid MAC mask request
+	// is rejected by ServeMACMask.
+	ErrInvalidMACMaskRequest = errors.New("invalid MAC mask request")
+)
+
+// ServeMACMask replies to an AoE MAC Mask List request using the MAC mask
+// list of Target t, as described in AoEr11, Section 3.3.
+//
+// ServeMACMask returns the number of bytes transmitted to a client, and any
+// errors which occurred while processing a request.
+//
+// For MACMaskCommandRead, the reply contains t's MAC mask list.  For
+// MACMaskCommandEdit, each Directive is applied to t's MAC mask list in
+// order, and the reply contains the resulting list.  If a Directive cannot
+// be applied, processing stops, and the reply's Error field is set to
+// MACMaskErrorBadCommand or MACMaskErrorListFull.  In this case, DirCount
+// indicates the index of the offending Directive, and Directives which
+// preceded it remain applied.
+//
+// Unknown MACMaskCommand values are answered with ErrorBadArgumentParameter.
+//
+// If r.Command is not CommandMACMaskList, or r.Arg is not a *MACMaskArg,
+// ErrInvalidMACMaskRequest is returned.
+func ServeMACMask(w ResponseSender, r *Request, t *Target) (int, error) {
+	// Ensure request intends to manipulate MAC mask list
+	if r.Command != CommandMACMaskList {
+		return 0, ErrInvalidMACMaskRequest
+	}
+	arg, ok := r.Arg.(*MACMaskArg)
+	if !ok {
+		return 0, ErrInvalidMACMaskRequest
+	}
+
+	switch arg.Command {
+	case MACMaskCommandRead:
+		// Reply with current list
+	case MACMaskCommandEdit:
+		// Apply directives, reporting the index of the first directive
+		// which fails
+		if merr, i := t.editMACMask(arg.Directives); merr != 0 {
+			return w.Send(&Header{
+				Arg: &MACMaskArg{
+					Command:    arg.Command,
+					Error:      merr,
+					DirCount:   uint8(i),
+					Directives: arg.Directives[:i],
+				},
+			})
+		}
+	default:
+		return w.Send(&Header{
+			Error: ErrorBadArgumentParameter,
+		})
+	}
+
+	macs := t.MACMask()
+	ds := make([]*Directive, 0, len(macs))
+	for _, m := range macs {
+		ds = append(ds, &Directive{
+			Command: DirectiveCommandNone,
+			MAC:     m,
+		})
+	}
+
+	return w.Send(&Header{
+		Arg: &MACMaskArg{
+			Command:    arg.Command,
+			DirCount:   uint8(len(ds)),
+			Directives: ds,
+		},
+	})
+}
+
+// serveTargetMACMask serves AoE MAC Mask List requests using the Target
+// associated with r.  Requests with no associated Target are ignored.
+func serveTargetMACMask(w ResponseSender, r *Request) {
+	if r.Target == nil {
+		return
+	}
+
+	_, _ = ServeMACMask(w, r, r.Target)
+}
+
+// editMACMask applies each Directive in ds to the Target's MAC mask list.
+// If a Directive cannot be applied, editMACMask returns a MACMaskError and
+// the index of the offending Directive.
+func (t *Target) editMACMask(ds []*Directive) (MACMaskError, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, d := range ds {
+		switch d.Command {
+		case DirectiveCommandNone:
+		case DirectiveCommandAdd:
+			if indexMAC(t.macMask, d.MAC) != -1 {
+				continue
+			}
+			if len(t.macMask) >= maxMACMaskLen {
+				return MACMaskErrorListFull, i
+			}
+
+			t.macMask = append(t.macMask, net.HardwareAddr(copyBytes(d.MAC)))
+		case DirectiveCommandDelete:
+			j := indexMAC(t.macMask, d.MAC)
+			if j == -1 {
+				continue
+			}
+
+			t.macMask = append(t.macMask[:j], t.macMask[j+1:]...)
+		default:
+			return MACMaskErrorBadCommand, i
+		}
+	}
+
+	return 0, 0
+}
+
+// maskAllows reports whether a client with hardware address mac may issue
+// ATA and config commands to the Target.  An empty MAC mask list permits
+// all clients.
+func (t *Target) maskAllows(mac net.HardwareAddr) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.macMask) == 0 || indexMAC(t.macMask, mac) != -1
+}
+
+// indexMAC returns the index of mac in macs, or -1 if mac is not present.
+func indexMAC(macs []net.HardwareAddr, mac net.HardwareAddr) int {
+	for i, m := range macs {
+		if bytes.Equal(m, mac) {
+			return i
+		}
+	}
+
+	return -1
+}
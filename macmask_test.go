@@ -0,0 +1,241 @@
+package aoe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+)
+
+func TestServeMACMask(t *testing.T) {
+	var (
+		macA = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}
+		macB = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+		macC = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	)
+
+	// list creates a reply MACMaskArg containing the MAC mask list macs
+	list := func(c MACMaskCommand, macs ...net.HardwareAddr) *MACMaskArg {
+		ds := make([]*Directive, 0, len(macs))
+		for _, m := range macs {
+			ds = append(ds, &Directive{MAC: m})
+		}
+
+		return &MACMaskArg{
+			Command:    c,
+			DirCount:   uint8(len(ds)),
+			Directives: ds,
+		}
+	}
+
+	// full creates a MAC mask list which is completely full
+	full := make([]net.HardwareAddr, 0, maxMACMaskLen)
+	for i := 0; i < maxMACMaskLen; i++ {
+		full = append(full, net.HardwareAddr{0, 0, 0, 0, 0, byte(i)})
+	}
+
+	var tests = []struct {
+		desc  string
+		r     *Header
+		mask  []net.HardwareAddr
+		w     *Header
+		after []net.HardwareAddr
+		err   error
+	}{
+		{
+			desc: "not CommandMACMaskList",
+			r: &Header{
+				Command: CommandIssueATACommand,
+			},
+			err: ErrInvalidMACMaskRequest,
+		},
+		{
+			desc: "not MACMaskArg",
+			r: &Header{
+				Command: CommandMACMaskList,
+				Arg:     &ConfigArg{},
+			},
+			err: ErrInvalidMACMaskRequest,
+		},
+		{
+			desc: "unknown command",
+			r:    macMaskRequest(0xff),
+			w: &Header{
+				Error: ErrorBadArgumentParameter,
+			},
+		},
+		{
+			desc:  "read empty",
+			r:     macMaskRequest(MACMaskCommandRead),
+			w:     &Header{Arg: list(MACMaskCommandRead)},
+			after: nil,
+		},
+		{
+			desc:  "read",
+			r:     macMaskRequest(MACMaskCommandRead),
+			mask:  []net.HardwareAddr{macA, macB},
+			w:     &Header{Arg: list(MACMaskCommandRead, macA, macB)},
+			after: []net.HardwareAddr{macA, macB},
+		},
+		{
+			desc: "edit add, delete, and no-op",
+			r: macMaskRequest(MACMaskCommandEdit,
+				&Directive{Command: DirectiveCommandAdd, MAC: macC},
+				&Directive{Command: DirectiveCommandAdd, MAC: macC},
+				&Directive{Command: DirectiveCommandNone, MAC: macB},
+				&Directive{Command: DirectiveCommandDelete, MAC: macA},
+				&Directive{Command: DirectiveCommandDelete, MAC: macA},
+			),
+			mask:  []net.HardwareAddr{macA, macB},
+			w:     &Header{Arg: list(MACMaskCommandEdit, macB, macC)},
+			after: []net.HardwareAddr{macB, macC},
+		},
+		{
+			desc: "edit bad directive command",
+			r: macMaskRequest(MACMaskCommandEdit,
+				&Directive{Command: DirectiveCommandAdd, MAC: macB},
+				&Directive{Command: 0xff, MAC: macC},
+				&Directive{Command: DirectiveCommandAdd, MAC: macC},
+			),
+			mask: []net.HardwareAddr{macA},
+			w: &Header{
+				Arg: &MACMaskArg{
+					Command:  MACMaskCommandEdit,
+					Error:    MACMaskErrorBadCommand,
+					DirCount: 1,
+					Directives: []*Directive{
+						{Command: DirectiveCommandAdd, MAC: macB},
+					},
+				},
+			},
+			after: []net.HardwareAddr{macA, macB},
+		},
+		{
+			desc: "edit list full",
+			r: macMaskRequest(MACMaskCommandEdit,
+				&Directive{Command: DirectiveCommandAdd, MAC: macA},
+			),
+			mask: full,
+			w: &Header{
+				Arg: &MACMaskArg{
+					Command:    MACMaskCommandEdit,
+					Error:      MACMaskErrorListFull,
+					Directives: []*Directive{},
+				},
+			},
+			after: full,
+		},
+	}
+
+	for i, tt := range tests {
+		target := new(Target)
+		target.SetMACMask(tt.mask)
+
+		w := &captureHeaderResponseSender{}
+		if _, err := ServeMACMask(w, &Request{Header: tt.r}, target); err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.w, w.h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+
+		if want, got := tt.after, target.MACMask(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected MAC mask list:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServerMACMaskAccessControl(t *testing.T) {
+	otherMAC := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	var tests = []struct {
+		desc  string
+		c     Command
+		mask  []net.HardwareAddr
+		reply bool
+	}{
+		{
+			desc:  "empty list permits config",
+			c:     CommandQueryConfigInformation,
+			reply: true,
+		},
+		{
+			desc:  "client on list permits config",
+			c:     CommandQueryConfigInformation,
+			mask:  []net.HardwareAddr{otherMAC, clientMAC},
+			reply: true,
+		},
+		{
+			desc: "client not on list drops config",
+			c:    CommandQueryConfigInformation,
+			mask: []net.HardwareAddr{otherMAC},
+		},
+		{
+			desc: "client not on list drops ATA",
+			c:    CommandIssueATACommand,
+			mask: []net.HardwareAddr{otherMAC},
+		},
+		{
+			desc:  "client not on list permits MAC mask list",
+			c:     CommandMACMaskList,
+			mask:  []net.HardwareAddr{otherMAC},
+			reply: true,
+		},
+	}
+
+	for i, tt := range tests {
+		s := testServer(HandlerFunc(func(w ResponseSender, r *Request) {
+			_, _ = w.Send(&Header{})
+		}))
+		s.Targets = NewTargetRegistry()
+
+		target := &Target{Major: 1, Minor: 2}
+		target.SetMACMask(tt.mask)
+		if err := s.Targets.Add(target); err != nil {
+			t.Fatalf("[%02d] test %q, failed to add target: %v", i, tt.desc, err)
+		}
+
+		h := testRequest()
+		h.Command = tt.c
+		switch tt.c {
+		case CommandIssueATACommand:
+			h.Arg = &ATAArg{}
+		case CommandMACMaskList:
+			h.Arg = &MACMaskArg{}
+		}
+
+		fs := serveFrames(t, s, &ethernet.Frame{
+			Destination: serverMAC,
+			Source:      clientMAC,
+			EtherType:   EtherType,
+			Payload:     mustMarshal(t, h),
+		})
+
+		if want, got := tt.reply, len(fs) == 1; want != got {
+			t.Fatalf("[%02d] test %q, unexpected reply: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+// macMaskRequest creates a MAC Mask List request Header with the specified
+// MACMaskCommand and Directives.
+func macMaskRequest(c MACMaskCommand, ds ...*Directive) *Header {
+	return &Header{
+		Command: CommandMACMaskList,
+		Arg: &MACMaskArg{
+			Command:    c,
+			DirCount:   uint8(len(ds)),
+			Directives: ds,
+		},
+	}
+}
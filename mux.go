@@ -0,0 +1,93 @@
+package aoe
+
+import (
+	"sync"
+)
+
+var (
+	// Compile-time interface check
+	_ Handler = &ServeMux{}
+)
+
+// A ServeMux is an AoE request multiplexer.  It matches the Command of each
+// incoming request against a set of registered Commands, and invokes the
+// Handler registered for that Command.
+//
+// If no Handler is registered for a request's Command, ServeMux replies with
+// ErrorUnrecognizedCommandCode.
+type ServeMux struct {
+	mu sync.RWMutex
+	m  map[Command]Handler
+}
+
+// NewServeMux creates a new, empty ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		m: make(map[Command]Handler),
+	}
+}
+
+// NewTargetServeMux creates a new ServeMux with this package's built-in
+// Handlers registered.  The built-in Handlers operate on the Target
+// associated with each Request, and are intended for use with a Server
+// configured with a TargetRegistry.
+//
+// The following Commands are handled:
+//   - CommandIssueATACommand: ServeATA, using the Target's Store
+//   - CommandQueryConfigInformation: ServeConfig
+//   - CommandMACMaskList: ServeMACMask
+//   - CommandReserveRelease: ServeReserveRelease
+//
+// Handlers may be replaced or wrapped to customize the behavior of a
+// ServeMux returned by NewTargetServeMux.
+func NewTargetServeMux() *ServeMux {
+	mux := NewServeMux()
+	mux.HandleFunc(CommandIssueATACommand, serveTargetATA)
+	mux.HandleFunc(CommandQueryConfigInformation, serveTargetConfig)
+	mux.HandleFunc(CommandMACMaskList, serveTargetMACMask)
+	mux.HandleFunc(CommandReserveRelease, serveTargetReserveRelease)
+
+	return mux
+}
+
+// Handle registers the Handler h for Command c.  If a Handler is already
+// registered for c, it is replaced by h.
+//
+// If h is nil, Handle panics.
+func (mux *ServeMux) Handle(c Command, h Handler) {
+	if h == nil {
+		panic("aoe: nil handler")
+	}
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	if mux.m == nil {
+		mux.m = make(map[Command]Handler)
+	}
+	mux.m[c] = h
+}
+
+// HandleFunc registers the handler function fn for Command c.
+func (mux *ServeMux) HandleFunc(c Command, fn func(ResponseSender, *Request)) {
+	mux.Handle(c, HandlerFunc(fn))
+}
+
+// ServeAoE dispatches a request to the Handler registered for its Command.
+func (mux *ServeMux) ServeAoE(w ResponseSender, r *Request) {
+	mux.mu.RLock()
+	h, ok := mux.m[r.Command]
+	mux.mu.RUnlock()
+
+	if !ok {
+		// Arg is echoed back to the client, as is required for all
+		// AoE error responses
+		_, _ = w.Send(&Header{
+			Error: ErrorUnrecognizedCommandCode,
+			Arg:   r.Arg,
+		})
+		return
+	}
+
+	h.ServeAoE(w, r)
+}
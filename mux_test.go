@@ -0,0 +1,92 @@
+package aoe
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestServeMux(t *testing.T) {
+	var tests = []struct {
+		desc string
+		c    Command
+		r    *Header
+		w    *Header
+	}{
+		{
+			desc: "unregistered command",
+			c:    CommandIssueATACommand,
+			r: &Header{
+				Version: Version,
+				Major:   1,
+				Minor:   2,
+				Command: CommandMACMaskList,
+				Tag:     [4]byte{1, 2, 3, 4},
+				Arg:     &MACMaskArg{},
+			},
+			w: &Header{
+				Error: ErrorUnrecognizedCommandCode,
+				Arg:   &MACMaskArg{},
+			},
+		},
+		{
+			desc: "registered command",
+			c:    CommandReserveRelease,
+			r: &Header{
+				Command: CommandReserveRelease,
+				Arg:     &ReserveReleaseArg{},
+			},
+			w: &Header{
+				Arg: &noopArg{},
+			},
+		},
+	}
+
+	for i, tt := range tests {
+		mux := NewServeMux()
+		mux.HandleFunc(tt.c, func(w ResponseSender, r *Request) {
+			_, _ = w.Send(&Header{
+				Arg: &noopArg{},
+			})
+		})
+
+		w := &captureHeaderResponseSender{}
+		mux.ServeAoE(w, &Request{Header: tt.r})
+
+		if want, got := tt.w, w.h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServeMuxHandleReplace(t *testing.T) {
+	var calls []int
+	mux := new(ServeMux)
+
+	for i := 0; i < 2; i++ {
+		i := i
+		mux.HandleFunc(CommandIssueATACommand, func(w ResponseSender, r *Request) {
+			calls = append(calls, i)
+		})
+	}
+
+	mux.ServeAoE(&captureHeaderResponseSender{}, &Request{
+		Header: &Header{
+			Command: CommandIssueATACommand,
+		},
+	})
+
+	if want, got := []int{1}, calls; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected handler calls:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+func TestServeMuxHandleNil(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatal("expected panic for nil handler")
+		}
+	}()
+
+	NewServeMux().Handle(CommandIssueATACommand, nil)
+}
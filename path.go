@@ -0,0 +1,296 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxPathFailures is the number of consecutive timeouts after which a path
+// is considered to be down.  Paths which are down are only used when no
+// other paths to a target are available.
+const maxPathFailures = 3
+
+// A clientConn is a Conn used by a Client, along with the network interface
+// it is bound to.
+type clientConn struct {
+	c   Conn
+	ifi *net.Interface
+
+	// err is set when the Conn's read loop stops, and is guarded by the
+	// Client's mutex.
+	err error
+}
+
+// A path is a route from a Client to an AoE target: a local Conn, and the
+// hardware address of a server which responded on behalf of the target.
+// Each path tracks its own failures, but all paths to the same server share
+// a round trip time estimate and request window, so that the number of
+// requests in flight to a server never exceeds its buffer count.
+type path struct {
+	conn *clientConn
+	mac  net.HardwareAddr
+
+	// w is nil for paths to targets which have not been opened, in which
+	// case requests are neither flow controlled nor retransmitted.
+	w *window
+
+	mu       sync.Mutex
+	failures int
+}
+
+// acquire acquires a slot in p's window, if p has one.
+func (p *path) acquire(ctx context.Context) error {
+	if p.w == nil {
+		return nil
+	}
+
+	return p.w.acquire(ctx)
+}
+
+// release releases a slot acquired by acquire.
+func (p *path) release() {
+	if p.w == nil {
+		return
+	}
+
+	p.w.release()
+}
+
+// rto returns p's retransmission timeout, or zero if requests using p
+// should not be retransmitted.
+func (p *path) rto() time.Duration {
+	if p.w == nil {
+		return 0
+	}
+
+	return p.w.rto()
+}
+
+// success records a response received using p.  rtt is the round trip time
+// of the request, or zero if the request was retransmitted and should not be
+// used to estimate round trip time.
+func (p *path) success(rtt time.Duration) {
+	p.mu.Lock()
+	p.failures = 0
+	p.mu.Unlock()
+
+	if p.w != nil && rtt > 0 {
+		p.w.success(rtt)
+	}
+}
+
+// loss records a request which was not answered using p.
+func (p *path) loss() {
+	p.mu.Lock()
+	p.failures++
+	p.mu.Unlock()
+
+	if p.w != nil {
+		p.w.loss()
+	}
+}
+
+// down reports whether p has stopped responding.
+func (p *path) down() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.failures >= maxPathFailures
+}
+
+// is reports whether p uses Conn cc to reach hardware address mac.
+func (p *path) is(cc *clientConn, mac net.HardwareAddr) bool {
+	return p.conn == cc && bytes.Equal(p.mac, mac)
+}
+
+// A pathSet is the set of known paths to a single AoE target.  Requests are
+// distributed across paths in round-robin order.
+type pathSet struct {
+	paths []*path
+	next  int
+}
+
+// window returns the window shared by the paths in ps which use the server
+// with hardware address mac, or nil if there is none.
+func (ps *pathSet) window(mac net.HardwareAddr) *window {
+	for _, p := range ps.paths {
+		if p.w != nil && bytes.Equal(p.mac, mac) {
+			return p.w
+		}
+	}
+
+	return nil
+}
+
+// AddInterface adds an additional Conn to the Client, bound to network
+// interface ifi.  Discovery and config requests are broadcast using every
+// Conn, and each combination of local Conn and remote server which responds
+// on behalf of a target is remembered as a path to the target.  ATA commands
+// issued by a Device are distributed across all paths to its target, and
+// are moved to another path when one stops responding.
+//
+// AddInterface starts a goroutine which reads responses from c.  Close
+// stops the goroutine and closes c.  If the Client is closed,
+// ErrClientClosed is returned.
+func (c *Client) AddInterface(conn Conn, ifi *net.Interface) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+
+	c.addConnLocked(conn, ifi)
+	return nil
+}
+
+// addConnLocked adds conn to the Client and starts its read loop.  The
+// caller must hold c.mu.
+func (c *Client) addConnLocked(conn Conn, ifi *net.Interface) {
+	cc := &clientConn{
+		c:   conn,
+		ifi: ifi,
+	}
+
+	c.conns = append(c.conns, cc)
+	c.loops++
+	go c.readLoop(cc)
+}
+
+// addPath records that the server with hardware address mac responded on
+// behalf of the target with the specified Major and Minor address, using
+// Conn cc.  If window is true, requests using the path are subject to flow
+// control and retransmission, and the window shared by all paths to the
+// server never exceeds the buffer count max.
+func (c *Client) addPath(major uint16, minor uint8, cc *clientConn, mac net.HardwareAddr, window bool, max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	addr := targetAddr{major: major, minor: minor}
+	ps, ok := c.targets[addr]
+	if !ok {
+		ps = new(pathSet)
+		c.targets[addr] = ps
+	}
+
+	p := &path{
+		conn: cc,
+		mac:  mac,
+	}
+	if window {
+		p.w = ps.window(mac)
+		if p.w == nil {
+			p.w = newWindow(max)
+		}
+	}
+
+	for i, pp := range ps.paths {
+		if !pp.is(cc, mac) {
+			continue
+		}
+
+		switch {
+		case window && pp.w == nil:
+			// Paths are shared by in-flight requests, so replace the path
+			// rather than adding a window to it
+			ps.paths[i] = p
+		case window:
+			pp.w.setMax(max)
+		}
+		return
+	}
+
+	ps.paths = append(ps.paths, p)
+}
+
+// paths returns the known paths to the target with the specified Major and
+// Minor address, beginning with the next path in round-robin order.  Paths
+// which are down, or whose Conn has stopped, are ordered last.
+func (c *Client) paths(major uint16, minor uint8) []*path {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ps, ok := c.targets[targetAddr{major: major, minor: minor}]
+	if !ok || len(ps.paths) == 0 {
+		return nil
+	}
+
+	start := ps.next % len(ps.paths)
+	ps.next++
+
+	up := make([]*path, 0, len(ps.paths))
+	var down []*path
+	for i := range ps.paths {
+		p := ps.paths[(start+i)%len(ps.paths)]
+		if p.conn.err != nil || p.down() {
+			down = append(down, p)
+			continue
+		}
+
+		up = append(up, p)
+	}
+
+	return append(up, down...)
+}
+
+// servers returns the number of distinct servers which responded on behalf
+// of the target with the specified Major and Minor address.
+func (c *Client) servers(major uint16, minor uint8) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ps, ok := c.targets[targetAddr{major: major, minor: minor}]
+	if !ok {
+		return 0
+	}
+
+	var n int
+	for i, p := range ps.paths {
+		seen := false
+		for _, pp := range ps.paths[:i] {
+			if bytes.Equal(p.mac, pp.mac) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			n++
+		}
+	}
+
+	return n
+}
+
+// pathsTo returns the known paths to the target with the specified Major
+// and Minor address which use the server with hardware address mac.  If
+// there are none, a single path using the first available Conn is returned.
+func (c *Client) pathsTo(major uint16, minor uint8, mac net.HardwareAddr) []*path {
+	var out []*path
+	for _, p := range c.paths(major, minor) {
+		if bytes.Equal(p.mac, mac) {
+			out = append(out, p)
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cc := c.conns[0]
+	for _, conn := range c.conns {
+		if conn.err == nil {
+			cc = conn
+			break
+		}
+	}
+
+	return []*path{{
+		conn: cc,
+		mac:  mac,
+	}}
+}
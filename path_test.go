@@ -0,0 +1,196 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClientMultipath(t *testing.T) {
+	target := &Target{
+		Major:       1,
+		Minor:       2,
+		BufferCount: 2,
+		SectorCount: 1,
+	}
+
+	// Two servers serve the same disk, each reached using a different Conn.
+	// Each server counts the ATA commands it serves, and drops them when
+	// instructed.
+	disk := &memDisk{b: make([]byte, 8*sectorSize)}
+	var (
+		served [2]int32
+		drop   [2]int32
+	)
+
+	hs := make([]Handler, 2)
+	for i := range hs {
+		i := i
+
+		mux := NewTargetServeMux()
+		mux.HandleFunc(CommandIssueATACommand, func(w ResponseSender, r *Request) {
+			if atomic.LoadInt32(&drop[i]) == 1 {
+				return
+			}
+
+			atomic.AddInt32(&served[i], 1)
+			disk.ServeAoE(w, r)
+		})
+		hs[i] = mux
+	}
+
+	c, done := testMultipathClient(t, target, hs...)
+	defer done()
+
+	d, err := c.OpenDevice(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatalf("failed to open device: %v", err)
+	}
+	if want, got := 2, len(c.paths(1, 2)); want != got {
+		t.Fatalf("unexpected number of paths: %v != %v", want, got)
+	}
+
+	// Commands are distributed across both paths
+	p := make([]byte, len(disk.b))
+	for i := range p {
+		p[i] = byte(i)
+	}
+
+	if _, err := d.WriteAt(p, 0); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	for i := range served {
+		if atomic.LoadInt32(&served[i]) == 0 {
+			t.Fatalf("no commands served by server %d", i)
+		}
+	}
+
+	// When the first server stops responding, commands fail over to the
+	// second server, and the first path is considered down
+	atomic.StoreInt32(&drop[0], 1)
+
+	r := make([]byte, len(p))
+	if _, err := d.ReadAt(r, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if want, got := p, r; !bytes.Equal(want, got) {
+		t.Fatal("unexpected data read from disk")
+	}
+
+	for _, pp := range c.paths(1, 2) {
+		if want, got := bytes.Equal(pp.mac, multipathMAC(0)), pp.down(); want != got {
+			t.Fatalf("unexpected down state for path to %s: %v != %v",
+				pp.mac, want, got)
+		}
+	}
+}
+
+func TestClientAddPathSharedWindow(t *testing.T) {
+	c := &Client{targets: make(map[targetAddr]*pathSet)}
+
+	// The first server is reached using two Conns, and the second server
+	// using only one
+	ccs := []*clientConn{{}, {}}
+	for _, cc := range ccs {
+		c.addPath(1, 2, cc, multipathMAC(0), true, 2)
+	}
+	c.addPath(1, 2, ccs[0], multipathMAC(1), true, 2)
+
+	ps := c.paths(1, 2)
+	if want, got := 3, len(ps); want != got {
+		t.Fatalf("unexpected number of paths: %v != %v", want, got)
+	}
+	if want, got := 2, c.servers(1, 2); want != got {
+		t.Fatalf("unexpected number of servers: %v != %v", want, got)
+	}
+
+	// Paths to the same server share a window, so that the server's buffer
+	// count is never exceeded
+	var first, second []*window
+	for _, p := range ps {
+		if bytes.Equal(p.mac, multipathMAC(0)) {
+			first = append(first, p.w)
+			continue
+		}
+
+		second = append(second, p.w)
+	}
+
+	if len(first) != 2 || first[0] != first[1] {
+		t.Fatal("paths to the same server do not share a window")
+	}
+	if len(second) != 1 || second[0] == first[0] {
+		t.Fatal("paths to different servers share a window")
+	}
+}
+
+func TestClientAddInterfaceClosed(t *testing.T) {
+	c, done := testClientServer(t, nil)
+	done()
+
+	cc, _ := newMemConnPair()
+	err := c.AddInterface(cc, &net.Interface{HardwareAddr: clientMAC})
+	if want, got := ErrClientClosed, err; want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+}
+
+// testMultipathClient creates a Client connected to one Server per Handler
+// in hs, each of which serves target.  Each Server uses a different hardware
+// address, and is reached using a different Conn.  Invoke the returned
+// function to stop the Client and all Servers.
+func testMultipathClient(t *testing.T, target *Target, hs ...Handler) (*Client, func()) {
+	var (
+		c     *Client
+		stops []func()
+	)
+
+	for i, h := range hs {
+		s := testServer(h)
+		s.Iface = &net.Interface{HardwareAddr: multipathMAC(i)}
+		s.Targets = NewTargetRegistry()
+		if err := s.Targets.Add(target); err != nil {
+			t.Fatalf("failed to add target: %v", err)
+		}
+
+		sc, cc := newMemConnPair()
+		serveDone := make(chan struct{})
+		go func() {
+			defer close(serveDone)
+			_ = s.Serve(sc)
+		}()
+
+		stops = append(stops, func() {
+			_ = s.Shutdown(context.Background())
+			<-serveDone
+		})
+
+		ifi := &net.Interface{HardwareAddr: clientMAC}
+		if c == nil {
+			c = NewClient(cc, ifi)
+			continue
+		}
+		if err := c.AddInterface(cc, ifi); err != nil {
+			t.Fatalf("failed to add interface: %v", err)
+		}
+	}
+
+	return c, func() {
+		_ = c.Close()
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// multipathMAC returns the hardware address of the i'th Server created by
+// testMultipathClient.
+func multipathMAC(i int) net.HardwareAddr {
+	mac := make(net.HardwareAddr, len(serverMAC))
+	copy(mac, serverMAC)
+	mac[len(mac)-1] += byte(i)
+
+	return mac
+}
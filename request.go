@@ -0,0 +1,64 @@
+package aoe
+
+import (
+	"context"
+	"net"
+)
+
+// A Request is an ATA over Ethernet request received by a Server.
+//
+// A Request wraps a Header with information about the Ethernet frame which
+// carried it, so that handlers can identify the client which issued the
+// request.
+type Request struct {
+	// Header is the AoE Header carried in the request.  Its fields are
+	// promoted to the Request.
+	*Header
+
+	// Source and Destination specify the hardware addresses from the
+	// Ethernet frame which carried the request.  Source is the hardware
+	// address of the client.  Destination may be the hardware address of
+	// the Server, or the Ethernet broadcast address.
+	Source      net.HardwareAddr
+	Destination net.HardwareAddr
+
+	// Iface specifies the network interface on which the request was
+	// received, if available.
+	Iface *net.Interface
+
+	// Target specifies the Target addressed by the request, if the Server
+	// which received the request is configured with a TargetRegistry.
+	// Broadcast requests are delivered to a Handler once for each matching
+	// Target.
+	Target *Target
+
+	ctx context.Context
+}
+
+// Context returns the request's context.  The context is canceled when the
+// request's handler returns, or when the Server which received the request
+// is forcibly shut down.
+//
+// If no context was set, Context returns context.Background.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+
+	return context.Background()
+}
+
+// WithContext returns a shallow copy of r with its context changed to ctx.
+//
+// If ctx is nil, WithContext panics.
+func (r *Request) WithContext(ctx context.Context) *Request {
+	if ctx == nil {
+		panic("aoe: nil context")
+	}
+
+	r2 := new(Request)
+	*r2 = *r
+	r2.ctx = ctx
+
+	return r2
+}
@@ -0,0 +1,63 @@
+package aoe
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+)
+
+func TestRequestContext(t *testing.T) {
+	r := &Request{
+		Header: testRequest(),
+	}
+
+	if want, got := context.Background(), r.Context(); want != got {
+		t.Fatalf("unexpected default context: %v != %v", want, got)
+	}
+
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "foo")
+
+	r2 := r.WithContext(ctx)
+	if want, got := ctx, r2.Context(); want != got {
+		t.Fatalf("unexpected context: %v != %v", want, got)
+	}
+	if want, got := r.Header, r2.Header; want != got {
+		t.Fatalf("unexpected Header: %v != %v", want, got)
+	}
+
+	// Original request must not be modified
+	if want, got := context.Background(), r.Context(); want != got {
+		t.Fatalf("original request context modified: %v != %v", want, got)
+	}
+}
+
+func TestServerRequestAddresses(t *testing.T) {
+	rC := make(chan *Request, 1)
+	h := HandlerFunc(func(w ResponseSender, r *Request) {
+		rC <- r
+	})
+
+	_ = serveFrames(t, testServer(h), &ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      clientMAC,
+		EtherType:   EtherType,
+		Payload:     mustMarshal(t, testRequest()),
+	})
+
+	r := <-rC
+	if want, got := clientMAC, r.Source; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected source:\n- want: %v\n-  got: %v", want, got)
+	}
+	if want, got := ethernet.Broadcast, r.Destination; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected destination:\n- want: %v\n-  got: %v", want, got)
+	}
+	if want, got := serverMAC, r.Iface.HardwareAddr; !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected interface address:\n- want: %v\n-  got: %v", want, got)
+	}
+	if err := r.Context().Err(); err != context.Canceled {
+		t.Fatalf("request context should be canceled after handler returns: %v", err)
+	}
+}
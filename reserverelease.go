@@ -0,0 +1,110 @@
+package aoe
+
+import (
+	"errors"
+	"net"
+)
+
+var (
+	// ErrInvalidReserveReleaseRequest is returned when an invalid
+	// reserve/release request is rejected by ServeReserveRelease.
+	ErrInvalidReserveReleaseRequest = errors.New("invalid reserve/release request")
+)
+
+// ServeReserveRelease replies to an AoE Reserve/Release request using the
+// reserve list of Target t, as described in AoEr11, Section 3.4.
+//
+// ServeReserveRelease returns the number of bytes transmitted to a client,
+// and any errors which occurred while processing a request.
+//
+// ServeReserveRelease handles each ReserveReleaseCommand as follows:
+//   - ReserveReleaseCommandRead: reply with t's reserve list.
+//   - ReserveReleaseCommandSet: if t's reserve list is empty, or the source
+//     address of the request is in t's reserve list, replace the reserve list
+//     with the argument list and reply.  Otherwise, reply with
+//     ErrorTargetIsReserved.
+//   - ReserveReleaseCommandForceSet: replace t's reserve list with the
+//     argument list, and reply.
+//
+// An empty argument list releases a Target.  Unknown ReserveReleaseCommand
+// values are answered with ErrorBadArgumentParameter.
+//
+// If r.Command is not CommandReserveRelease, or r.Arg is not a
+// *ReserveReleaseArg, ErrInvalidReserveReleaseRequest is returned.
+func ServeReserveRelease(w ResponseSender, r *Request, t *Target) (int, error) {
+	// Ensure request intends to manipulate reserve list
+	if r.Command != CommandReserveRelease {
+		return 0, ErrInvalidReserveReleaseRequest
+	}
+	arg, ok := r.Arg.(*ReserveReleaseArg)
+	if !ok {
+		return 0, ErrInvalidReserveReleaseRequest
+	}
+
+	switch arg.Command {
+	case ReserveReleaseCommandRead:
+		// Reply with current list
+	case ReserveReleaseCommandSet:
+		// Set only if not reserved by another client
+		if !t.setReserveIfAllowed(r.Source, arg.MACs) {
+			return w.Send(&Header{
+				Error: ErrorTargetIsReserved,
+			})
+		}
+	case ReserveReleaseCommandForceSet:
+		// Always set reserve list
+		t.SetReserve(arg.MACs)
+	default:
+		return w.Send(&Header{
+			Error: ErrorBadArgumentParameter,
+		})
+	}
+
+	macs := t.Reserve()
+	if macs == nil {
+		macs = make([]net.HardwareAddr, 0)
+	}
+
+	return w.Send(&Header{
+		Arg: &ReserveReleaseArg{
+			Command: arg.Command,
+			NMACs:   uint8(len(macs)),
+			MACs:    macs,
+		},
+	})
+}
+
+// serveTargetReserveRelease serves AoE Reserve/Release requests using the
+// Target associated with r.  Requests with no associated Target are ignored.
+func serveTargetReserveRelease(w ResponseSender, r *Request) {
+	if r.Target == nil {
+		return
+	}
+
+	_, _ = ServeReserveRelease(w, r, r.Target)
+}
+
+// setReserveIfAllowed replaces the Target's reserve list with macs, if and
+// only if the reserve list is empty or contains src.  It reports whether
+// the reserve list was replaced.
+func (t *Target) setReserveIfAllowed(src net.HardwareAddr, macs []net.HardwareAddr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.reserve) > 0 && indexMAC(t.reserve, src) == -1 {
+		return false
+	}
+
+	t.reserve = copyMACs(macs)
+	return true
+}
+
+// reserveAllows reports whether a client with hardware address mac may
+// issue ATA commands to the Target.  An empty reserve list permits all
+// clients.
+func (t *Target) reserveAllows(mac net.HardwareAddr) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.reserve) == 0 || indexMAC(t.reserve, mac) != -1
+}
@@ -0,0 +1,277 @@
+package aoe
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+)
+
+func TestServeReserveRelease(t *testing.T) {
+	var (
+		macA = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}
+		macB = net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+	)
+
+	// list creates a reply ReserveReleaseArg containing the reserve list macs
+	list := func(c ReserveReleaseCommand, macs ...net.HardwareAddr) *Header {
+		if macs == nil {
+			macs = make([]net.HardwareAddr, 0)
+		}
+
+		return &Header{
+			Arg: &ReserveReleaseArg{
+				Command: c,
+				NMACs:   uint8(len(macs)),
+				MACs:    macs,
+			},
+		}
+	}
+
+	var tests = []struct {
+		desc    string
+		r       *Header
+		reserve []net.HardwareAddr
+		w       *Header
+		after   []net.HardwareAddr
+		err     error
+	}{
+		{
+			desc: "not CommandReserveRelease",
+			r: &Header{
+				Command: CommandIssueATACommand,
+			},
+			err: ErrInvalidReserveReleaseRequest,
+		},
+		{
+			desc: "not ReserveReleaseArg",
+			r: &Header{
+				Command: CommandReserveRelease,
+				Arg:     &ConfigArg{},
+			},
+			err: ErrInvalidReserveReleaseRequest,
+		},
+		{
+			desc: "unknown command",
+			r:    reserveReleaseRequest(0xff),
+			w: &Header{
+				Error: ErrorBadArgumentParameter,
+			},
+		},
+		{
+			desc: "read empty",
+			r:    reserveReleaseRequest(ReserveReleaseCommandRead),
+			w:    list(ReserveReleaseCommandRead),
+		},
+		{
+			desc:    "read",
+			r:       reserveReleaseRequest(ReserveReleaseCommandRead),
+			reserve: []net.HardwareAddr{macA},
+			w:       list(ReserveReleaseCommandRead, macA),
+			after:   []net.HardwareAddr{macA},
+		},
+		{
+			desc:  "set, empty list",
+			r:     reserveReleaseRequest(ReserveReleaseCommandSet, clientMAC, macA),
+			w:     list(ReserveReleaseCommandSet, clientMAC, macA),
+			after: []net.HardwareAddr{clientMAC, macA},
+		},
+		{
+			desc:    "set, source in list",
+			r:       reserveReleaseRequest(ReserveReleaseCommandSet, macB),
+			reserve: []net.HardwareAddr{macA, clientMAC},
+			w:       list(ReserveReleaseCommandSet, macB),
+			after:   []net.HardwareAddr{macB},
+		},
+		{
+			desc:    "set, release",
+			r:       reserveReleaseRequest(ReserveReleaseCommandSet),
+			reserve: []net.HardwareAddr{clientMAC},
+			w:       list(ReserveReleaseCommandSet),
+		},
+		{
+			desc:    "set, target is reserved",
+			r:       reserveReleaseRequest(ReserveReleaseCommandSet, clientMAC),
+			reserve: []net.HardwareAddr{macA},
+			w: &Header{
+				Error: ErrorTargetIsReserved,
+			},
+			after: []net.HardwareAddr{macA},
+		},
+		{
+			desc:    "force set",
+			r:       reserveReleaseRequest(ReserveReleaseCommandForceSet, clientMAC),
+			reserve: []net.HardwareAddr{macA},
+			w:       list(ReserveReleaseCommandForceSet, clientMAC),
+			after:   []net.HardwareAddr{clientMAC},
+		},
+	}
+
+	for i, tt := range tests {
+		target := new(Target)
+		target.SetReserve(tt.reserve)
+
+		r := &Request{
+			Header: tt.r,
+			Source: clientMAC,
+		}
+
+		w := &captureHeaderResponseSender{}
+		if _, err := ServeReserveRelease(w, r, target); err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.w, w.h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+
+		if want, got := tt.after, target.Reserve(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected reserve list:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServerReserveRelease(t *testing.T) {
+	otherMAC := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}
+
+	var tests = []struct {
+		desc    string
+		h       *Header
+		reserve []net.HardwareAddr
+		w       *Header
+	}{
+		{
+			desc:    "ATA command, target reserved by other client",
+			h:       ataCheckPowerRequest(),
+			reserve: []net.HardwareAddr{otherMAC},
+			w: func() *Header {
+				h := ataCheckPowerRequest()
+				h.FlagResponse = true
+				h.FlagError = true
+				h.Error = ErrorTargetIsReserved
+
+				// Request argument is echoed, including Ethernet padding
+				h.Arg = &ATAArg{
+					CmdStatus: ATACmdStatusCheckPower,
+					Data:      make([]byte, 46-headerLen-ataArgLen),
+				}
+				return h
+			}(),
+		},
+		{
+			desc:    "ATA command, target reserved by client",
+			h:       ataCheckPowerRequest(),
+			reserve: []net.HardwareAddr{clientMAC},
+			w: func() *Header {
+				h := ataCheckPowerRequest()
+				h.FlagResponse = true
+				// Reply is padded to the minimum Ethernet frame size
+				h.Arg = &ATAArg{
+					SectorCount: 0xff,
+					CmdStatus:   ATACmdStatusReadyStatus,
+					Data:        make([]byte, 46-headerLen-ataArgLen),
+				}
+				return h
+			}(),
+		},
+		{
+			// Request is padded to the minimum Ethernet frame size
+			desc:    "reserve set, target reserved by client",
+			h:       testReserveRequest(ReserveReleaseCommandSet, otherMAC),
+			reserve: []net.HardwareAddr{clientMAC},
+			w: func() *Header {
+				h := testReserveRequest(ReserveReleaseCommandSet, otherMAC)
+				h.FlagResponse = true
+				return h
+			}(),
+		},
+	}
+
+	for i, tt := range tests {
+		s := testServer(nil)
+		s.Targets = NewTargetRegistry()
+
+		target := &Target{
+			Major: 1,
+			Minor: 2,
+			Store: &noopReadWriteSeeker{},
+		}
+		target.SetReserve(tt.reserve)
+		if err := s.Targets.Add(target); err != nil {
+			t.Fatalf("[%02d] test %q, failed to add target: %v", i, tt.desc, err)
+		}
+
+		fs := serveFrames(t, s, &ethernet.Frame{
+			Destination: serverMAC,
+			Source:      clientMAC,
+			EtherType:   EtherType,
+			Payload:     mustMarshal(t, tt.h),
+		})
+		if len(fs) != 1 {
+			t.Fatalf("[%02d] test %q, expected one reply, but got %d", i, tt.desc, len(fs))
+		}
+
+		h := new(Header)
+		if err := h.UnmarshalBinary(trimPadding(fs[0].Payload)); err != nil {
+			t.Fatalf("[%02d] test %q, failed to unmarshal reply: %v", i, tt.desc, err)
+		}
+
+		if want, got := tt.w, h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+// reserveReleaseRequest creates a Reserve/Release request Header with the
+// specified ReserveReleaseCommand and hardware addresses.
+func reserveReleaseRequest(c ReserveReleaseCommand, macs ...net.HardwareAddr) *Header {
+	if macs == nil {
+		macs = make([]net.HardwareAddr, 0)
+	}
+
+	return &Header{
+		Command: CommandReserveRelease,
+		Arg: &ReserveReleaseArg{
+			Command: c,
+			NMACs:   uint8(len(macs)),
+			MACs:    macs,
+		},
+	}
+}
+
+// testReserveRequest creates a complete Reserve/Release request Header
+// addressed to major 1, minor 2.
+func testReserveRequest(c ReserveReleaseCommand, macs ...net.HardwareAddr) *Header {
+	h := reserveReleaseRequest(c, macs...)
+	h.Version = Version
+	h.Major = 1
+	h.Minor = 2
+	h.Tag = [4]byte{0xde, 0xad, 0xbe, 0xef}
+
+	return h
+}
+
+// ataCheckPowerRequest creates a complete ATA check power mode request
+// Header addressed to major 1, minor 2.
+func ataCheckPowerRequest() *Header {
+	return &Header{
+		Version: Version,
+		Major:   1,
+		Minor:   2,
+		Command: CommandIssueATACommand,
+		Tag:     [4]byte{0xde, 0xad, 0xbe, 0xef},
+		Arg: &ATAArg{
+			CmdStatus: ATACmdStatusCheckPower,
+			Data:      make([]byte, 0),
+		},
+	}
+}
@@ -0,0 +1,583 @@
+package aoe
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+const (
+	// maxFrameLen is the maximum length of an Ethernet frame read by a
+	// Server.  It is large enough to accommodate jumbo frames with a 9000
+	// byte MTU, an Ethernet header, and an IEEE 802.1Q VLAN tag.
+	maxFrameLen = 9000 + 14 + 4
+
+	// malformedLogInterval is the minimum interval between log messages for
+	// malformed requests.
+	malformedLogInterval = 10 * time.Second
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to
+// Server.Shutdown.
+var ErrServerClosed = errors.New("server closed")
+
+// A Conn is a frame-level network connection, which can read and write
+// raw Ethernet frames.
+//
+// A raw socket bound to EtherType, such as one provided by package raw
+// (https://github.com/mdlayher/raw), can be easily adapted to implement
+// Conn.  An in-memory implementation can be used for testing.
+type Conn interface {
+	// ReadFrame reads a single Ethernet frame into b, returning the number
+	// of bytes read.
+	ReadFrame(b []byte) (int, error)
+
+	// WriteFrame writes a single Ethernet frame b, returning the number of
+	// bytes written.
+	WriteFrame(b []byte) (int, error)
+
+	// Close closes the connection.  Any blocked ReadFrame or WriteFrame
+	// operations must be unblocked and return an error.
+	Close() error
+}
+
+// A Server serves ATA over Ethernet requests received on one or more Conns.
+//
+// The ResponseSender passed to each Handler by a Server automatically fills
+// in the Version, Major, Minor, Command, and Tag fields of a reply Header
+// using the values from the request, and sets FlagResponse.  When a request
+// is addressed to a Target, the Target's Major and Minor address is used
+// instead, so that broadcast requests receive one reply per Target.  If the
+// reply's Error field is set, FlagError is set as well, and if the reply's
+// Arg field is nil, the request's Arg is echoed back to the client.  Replies
+// are addressed to the hardware address of the client which issued a
+// request.
+type Server struct {
+	// Iface specifies the network interface used by the Server.  The
+	// hardware address of Iface is used as the source address for all
+	// replies sent by the Server.
+	Iface *net.Interface
+
+	// Targets specifies an optional set of Targets served by the Server.
+	//
+	// If Targets is not nil, the Server consults it for each request.  The
+	// Handler is invoked once for each Target addressed by a request, and
+	// requests which address no Targets are silently ignored.  ATA and
+	// config requests from clients which are not present in a Target's
+	// non-empty MAC mask list are also silently ignored.  ATA requests from
+	// clients which are not present in a Target's non-empty reserve list
+	// are answered with ErrorTargetIsReserved.
+	//
+	// If Targets is nil, the Handler is invoked once for every request.
+	Targets *TargetRegistry
+
+	// Handler is invoked for AoE requests received by the Server.
+	//
+	// If Handler is nil, a ServeMux created by NewTargetServeMux is used.
+	Handler Handler
+
+	// ErrorLog specifies an optional logger for errors which occur while
+	// processing requests.  If nil, errors are logged using package log.
+	ErrorLog *log.Logger
+
+	mu     sync.Mutex
+	conns  map[Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+
+	// malformedAt is the time a malformed request was last logged, and
+	// malformed is the number of malformed requests since then which were
+	// not logged.
+	malformedAt time.Time
+	malformed   int
+
+	// defaultMux is used when Handler is nil.
+	defaultMux *ServeMux
+
+	// ctx is the parent context for all requests, and is canceled if
+	// Shutdown does not complete gracefully.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Serve reads Ethernet frames from c, and invokes s.Handler for each AoE
+// request it receives.  Frames which do not carry EtherType, cannot be
+// unmarshaled into a Header, or are responses from other servers are
+// ignored.
+//
+// Requests with an unrecognized Command are passed to s.Handler with an Arg
+// containing the raw argument bytes, so that a ServeMux can reply with
+// ErrorUnrecognizedCommandCode.  Requests with an unsupported Version are
+// answered with ErrorUnsupportedVersion, as described in AoEr11, Section
+// 2.4.
+//
+// Each request is handled in its own goroutine.  Serve always returns a
+// non-nil error.  After Shutdown is called, Serve returns ErrServerClosed.
+func (s *Server) Serve(c Conn) error {
+	if !s.trackConn(c) {
+		_ = c.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackConn(c)
+
+	b := make([]byte, maxFrameLen)
+	for {
+		n, err := c.ReadFrame(b)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+
+			return err
+		}
+
+		// Drop any new requests once shutdown has begun; c will be closed
+		// by Shutdown once in-flight requests complete
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			continue
+		}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		// Copy frame so the read buffer can be reused immediately
+		fb := make([]byte, n)
+		copy(fb, b[:n])
+
+		go func() {
+			defer s.wg.Done()
+			s.serveFrame(c, fb)
+		}()
+	}
+}
+
+// Shutdown gracefully shuts down the Server.  Shutdown stops the Server from
+// handling any new requests, waits for all in-flight requests to complete,
+// and then closes all Conns being served.
+//
+// Once all requests complete, Shutdown waits for any queued asynchronous
+// writes to be applied to the Stores of the Server's Targets, such as
+// Stores of type *WriteBack.
+//
+// If ctx is canceled before all requests complete, Shutdown closes all Conns
+// immediately and returns the context's error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-done:
+		err = s.flushTargets()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Notify any remaining handlers that the Server is going away
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	for c := range s.conns {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// A flusher is a Store which can apply queued writes, such as *WriteBack.
+type flusher interface {
+	Flush() error
+}
+
+// flushTargets applies queued writes for the Stores of each of the Server's
+// Targets, and returns the first error which occurs.
+func (s *Server) flushTargets() error {
+	if s.Targets == nil {
+		return nil
+	}
+
+	var err error
+	for _, t := range s.Targets.Lookup(&Header{Major: BroadcastMajor, Minor: BroadcastMinor}) {
+		f, ok := t.Store.(flusher)
+		if !ok {
+			continue
+		}
+
+		if ferr := f.Flush(); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+
+	return err
+}
+
+// serveFrame unpacks an AoE request from the Ethernet frame b, and invokes
+// s.Handler with a ResponseSender which replies using c.
+func (s *Server) serveFrame(c Conn, b []byte) {
+	f := new(ethernet.Frame)
+	if err := f.UnmarshalBinary(b); err != nil {
+		return
+	}
+	if f.EtherType != EtherType {
+		return
+	}
+
+	h, err := parseRequest(trimPadding(f.Payload))
+	if err != nil {
+		s.logMalformed(f.Source, err)
+		return
+	}
+
+	// Ignore responses from other servers on the same network
+	if h.FlagResponse {
+		return
+	}
+
+	handler := s.handler()
+	if h.Version != Version {
+		handler = unsupportedVersionHandler
+	}
+
+	// Without a registry, the handler is solely responsible for the request
+	if s.Targets == nil {
+		s.serveRequest(handler, c, f, h, nil)
+		return
+	}
+
+	// Broadcast requests are served once per matching target, and requests
+	// for unknown addresses are ignored
+	for _, t := range s.Targets.Lookup(h) {
+		// Enforce access control for ATA and config commands
+		switch h.Command {
+		case CommandIssueATACommand, CommandQueryConfigInformation:
+			if !t.maskAllows(f.Source) {
+				continue
+			}
+		}
+
+		// Only reserving clients may issue ATA commands
+		if h.Command == CommandIssueATACommand && !t.reserveAllows(f.Source) {
+			s.serveRequest(reservedHandler, c, f, h, t)
+			continue
+		}
+
+		s.serveRequest(handler, c, f, h, t)
+	}
+}
+
+// reservedHandler replies to requests for a Target which is reserved by
+// other clients.
+var reservedHandler = HandlerFunc(func(w ResponseSender, r *Request) {
+	_, _ = w.Send(&Header{
+		Error: ErrorTargetIsReserved,
+	})
+})
+
+// serveRequest invokes handler with a Request for Header h, optionally
+// addressed to Target t, which arrived in Ethernet frame f.
+func (s *Server) serveRequest(handler Handler, c Conn, f *ethernet.Frame, h *Header, t *Target) {
+	ctx, cancel := context.WithCancel(s.context())
+	defer cancel()
+
+	r := &Request{
+		Header:      h,
+		Source:      f.Source,
+		Destination: f.Destination,
+		Iface:       s.Iface,
+		Target:      t,
+		ctx:         ctx,
+	}
+
+	w := &response{
+		c:     c,
+		req:   h,
+		major: h.Major,
+		minor: h.Minor,
+		src:   s.hardwareAddr(),
+		dst:   f.Source,
+	}
+	if t != nil {
+		w.major = t.Major
+		w.minor = t.Minor
+	}
+
+	handler.ServeAoE(w, r)
+}
+
+// handler returns s.Handler, or a ServeMux created by NewTargetServeMux if
+// s.Handler is nil.
+func (s *Server) handler() Handler {
+	if s.Handler != nil {
+		return s.Handler
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.defaultMux == nil {
+		s.defaultMux = NewTargetServeMux()
+	}
+
+	return s.defaultMux
+}
+
+// context returns the parent context for all requests served by s.
+func (s *Server) context() context.Context {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+
+	return s.ctx
+}
+
+// unsupportedVersionHandler replies to requests which use an unsupported
+// AoE protocol version.
+var unsupportedVersionHandler = HandlerFunc(func(w ResponseSender, r *Request) {
+	_, _ = w.Send(&Header{
+		Error: ErrorUnsupportedVersion,
+	})
+})
+
+// parseRequest unmarshals a request Header from b.  If the Header is
+// readable, but its Version is unsupported or its Command is unrecognized,
+// its fields are returned along with its raw argument, so that the client
+// can be sent an error reply.
+func parseRequest(b []byte) (*Header, error) {
+	h := new(Header)
+	err := h.UnmarshalBinary(b)
+	switch err {
+	case nil:
+		return h, nil
+	case ErrorUnsupportedVersion, ErrorUnrecognizedCommandCode:
+	default:
+		return nil, err
+	}
+
+	a := new(rawArg)
+	if err := a.UnmarshalBinary(b[headerLen:]); err != nil {
+		return nil, err
+	}
+
+	h = &Header{
+		Version:      b[0] >> 4,
+		FlagResponse: (b[0] & 0x08) != 0,
+		FlagError:    (b[0] & 0x04) != 0,
+		Error:        Error(b[1]),
+		Major:        binary.BigEndian.Uint16(b[2:4]),
+		Minor:        b[4],
+		Command:      Command(b[5]),
+		Arg:          a,
+	}
+	copy(h.Tag[:], b[6:10])
+
+	return h, nil
+}
+
+// A rawArg is the unparsed argument of a request which cannot be
+// unmarshaled by this package, such as one with a vendor-specific Command.
+// It is echoed back to clients in error replies.
+type rawArg []byte
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (a *rawArg) MarshalBinary() ([]byte, error) {
+	return copyBytes(*a), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (a *rawArg) UnmarshalBinary(b []byte) error {
+	*a = copyBytes(b)
+	return nil
+}
+
+// trimPadding removes any Ethernet frame padding from the end of the AoE
+// payload b.  Most AoE arguments tolerate trailing padding, but the data of
+// an ATAArg must contain exactly the number of sectors specified by its
+// sector count, and a ReserveReleaseArg must contain exactly the number of
+// hardware addresses specified by its length field.
+func trimPadding(b []byte) []byte {
+	if len(b) < headerLen {
+		return b
+	}
+
+	var n int
+	switch Command(b[5]) {
+	case CommandIssueATACommand:
+		// The data carried by a response is not described by its argument
+		if b[0]&0x08 != 0 || len(b) < headerLen+ataArgLen {
+			return b
+		}
+
+		// Only write requests carry data
+		n = headerLen + ataArgLen
+		if b[headerLen]&0x01 != 0 {
+			n += sectorSize * int(b[headerLen+2])
+		}
+	case CommandReserveRelease:
+		if len(b) < headerLen+reserveReleaseArgLen {
+			return b
+		}
+
+		n = headerLen + reserveReleaseArgLen + 6*int(b[headerLen+1])
+	default:
+		return b
+	}
+
+	if n >= len(b) {
+		return b
+	}
+
+	return b[:n]
+}
+
+// hardwareAddr returns the hardware address of s.Iface, if available.
+func (s *Server) hardwareAddr() net.HardwareAddr {
+	if s.Iface == nil {
+		return nil
+	}
+
+	return s.Iface.HardwareAddr
+}
+
+// trackConn adds c to the set of Conns closed by Shutdown.  It reports
+// false if the Server is already shut down.
+func (s *Server) trackConn(c Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[Conn]struct{})
+	}
+	s.conns[c] = struct{}{}
+
+	return true
+}
+
+// untrackConn removes c from the set of Conns closed by Shutdown.
+func (s *Server) untrackConn(c Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, c)
+}
+
+// isClosed reports whether Shutdown has been called.
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// logMalformed logs that a malformed request was received from src.  At
+// most one message is logged per malformedLogInterval, so that hosts on the
+// network cannot flood the log.
+func (s *Server) logMalformed(src net.HardwareAddr, err error) {
+	s.mu.Lock()
+	now := time.Now()
+	if !s.malformedAt.IsZero() && now.Sub(s.malformedAt) < malformedLogInterval {
+		s.malformed++
+		s.mu.Unlock()
+		return
+	}
+
+	suppressed := s.malformed
+	s.malformedAt = now
+	s.malformed = 0
+	s.mu.Unlock()
+
+	if suppressed > 0 {
+		s.logf("aoe: failed to unmarshal header from %s: %v (%d more malformed requests not logged)",
+			src, err, suppressed)
+		return
+	}
+
+	s.logf("aoe: failed to unmarshal header from %s: %v", src, err)
+}
+
+// logf logs a formatted message using s.ErrorLog, or package log if
+// s.ErrorLog is nil.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, v...)
+		return
+	}
+
+	log.Printf(format, v...)
+}
+
+// response is a ResponseSender which mirrors fields from a request Header
+// into a reply, encapsulates the reply in an Ethernet frame, and sends it to
+// the client which issued the request.
+type response struct {
+	c     Conn
+	req   *Header
+	major uint16
+	minor uint8
+	src   net.HardwareAddr
+	dst   net.HardwareAddr
+}
+
+// Send fills in the reply Header h using fields from the request, and sends
+// it to the client which issued the request.  h is not modified.
+func (r *response) Send(h *Header) (int, error) {
+	rh := *h
+	rh.Version = Version
+	rh.FlagResponse = true
+	rh.Major = r.major
+	rh.Minor = r.minor
+	rh.Command = r.req.Command
+	rh.Tag = r.req.Tag
+
+	// Error replies carry the request's argument, unless the handler
+	// specifies otherwise
+	if rh.Error != 0 {
+		rh.FlagError = true
+	}
+	if rh.Arg == nil {
+		rh.Arg = r.req.Arg
+	}
+
+	hb, err := rh.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	f := &ethernet.Frame{
+		Destination: r.dst,
+		Source:      r.src,
+		EtherType:   EtherType,
+		Payload:     hb,
+	}
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+
+	return r.c.WriteFrame(fb)
+}
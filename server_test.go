@@ -0,0 +1,635 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+var (
+	serverMAC = net.HardwareAddr{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}
+	clientMAC = net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+)
+
+func TestServerServe(t *testing.T) {
+	var tests = []struct {
+		desc string
+		f    *ethernet.Frame
+		h    *Header
+	}{
+		{
+			desc: "wrong EtherType",
+			f: &ethernet.Frame{
+				Destination: serverMAC,
+				Source:      clientMAC,
+				EtherType:   0x0800,
+				Payload:     mustMarshal(t, testRequest()),
+			},
+		},
+		{
+			desc: "malformed header",
+			f: &ethernet.Frame{
+				Destination: serverMAC,
+				Source:      clientMAC,
+				EtherType:   EtherType,
+				// Reserve/release argument with too few hardware addresses
+				Payload: []byte{0x10, 0, 0, 0, 0, 0x03, 0, 0, 0, 0, 0, 0xff},
+			},
+		},
+		{
+			desc: "response from another server",
+			f: &ethernet.Frame{
+				Destination: serverMAC,
+				Source:      clientMAC,
+				EtherType:   EtherType,
+				Payload: mustMarshal(t, func() *Header {
+					h := testRequest()
+					h.FlagResponse = true
+					return h
+				}()),
+			},
+		},
+		{
+			desc: "OK",
+			f: &ethernet.Frame{
+				Destination: serverMAC,
+				Source:      clientMAC,
+				EtherType:   EtherType,
+				Payload:     mustMarshal(t, testRequest()),
+			},
+			h: func() *Header {
+				h := testRequest()
+				h.FlagResponse = true
+				return h
+			}(),
+		},
+	}
+
+	for i, tt := range tests {
+		echo := HandlerFunc(func(w ResponseSender, r *Request) {
+			h := *r.Header
+			h.FlagResponse = true
+			_, _ = w.Send(&h)
+		})
+
+		f, ok := serveOne(t, echo, tt.f)
+		if tt.h == nil {
+			if ok {
+				t.Fatalf("[%02d] test %q, unexpected reply: %v", i, tt.desc, f)
+			}
+
+			continue
+		}
+		if !ok {
+			t.Fatalf("[%02d] test %q, no reply from server", i, tt.desc)
+		}
+
+		if want, got := clientMAC, f.Destination; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected destination:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := serverMAC, f.Source; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected source:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+
+		h := new(Header)
+		if err := h.UnmarshalBinary(f.Payload); err != nil {
+			t.Fatalf("[%02d] test %q, failed to unmarshal reply: %v", i, tt.desc, err)
+		}
+		if want, got := tt.h, h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServerServeATAPadding(t *testing.T) {
+	// A write without any sectors is padded to the minimum Ethernet frame
+	// length
+	h := testRequest()
+	h.Command = CommandIssueATACommand
+	h.Arg = &ATAArg{
+		FlagWrite: true,
+		CmdStatus: ATACmdStatusWrite28Bit,
+	}
+
+	dataC := make(chan []byte, 1)
+	_, _ = serveOne(t, HandlerFunc(func(w ResponseSender, r *Request) {
+		dataC <- r.Arg.(*ATAArg).Data
+	}), &ethernet.Frame{
+		Destination: serverMAC,
+		Source:      clientMAC,
+		EtherType:   EtherType,
+		Payload:     mustMarshal(t, h),
+	})
+
+	// Padding must not be mistaken for sector data
+	if want, got := 0, len(<-dataC); want != got {
+		t.Fatalf("unexpected ATA data length: %v != %v", want, got)
+	}
+}
+
+func TestServerServeErrors(t *testing.T) {
+	// vendorCommand is a vendor-specific Command, in the range 0xf0-0xff
+	const vendorCommand = Command(0xf0)
+
+	var tests = []struct {
+		desc    string
+		payload []byte
+		err     Error
+	}{
+		{
+			desc: "unsupported version",
+			payload: func() []byte {
+				b := mustMarshal(t, testRequest())
+				b[0] = 0x20
+				return b
+			}(),
+			err: ErrorUnsupportedVersion,
+		},
+		{
+			desc: "unrecognized command",
+			payload: func() []byte {
+				b := mustMarshal(t, testRequest())
+				b[5] = 0xf1
+				return b
+			}(),
+			err: ErrorUnrecognizedCommandCode,
+		},
+		{
+			desc: "vendor command",
+			payload: func() []byte {
+				b := mustMarshal(t, testRequest())
+				b[5] = byte(vendorCommand)
+				return b
+			}(),
+			err: ErrorTargetIsReserved,
+		},
+	}
+
+	for i, tt := range tests {
+		mux := NewServeMux()
+		mux.HandleFunc(vendorCommand, func(w ResponseSender, r *Request) {
+			_, _ = w.Send(&Header{
+				Error: ErrorTargetIsReserved,
+			})
+		})
+
+		f, ok := serveOne(t, mux, &ethernet.Frame{
+			Destination: serverMAC,
+			Source:      clientMAC,
+			EtherType:   EtherType,
+			Payload:     tt.payload,
+		})
+		if !ok {
+			t.Fatalf("[%02d] test %q, no reply from server", i, tt.desc)
+		}
+
+		// The reply Command may not be known to this package, so check the
+		// reply's fields directly
+		b := f.Payload
+		if want, got := uint8(Version), b[0]>>4; want != got {
+			t.Fatalf("[%02d] test %q, unexpected version: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := uint8(0x0c), b[0]&0x0c; want != got {
+			t.Fatalf("[%02d] test %q, unexpected flags: %#02x != %#02x",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.err, Error(b[1]); want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.payload[5], b[5]; want != got {
+			t.Fatalf("[%02d] test %q, unexpected command: %#02x != %#02x",
+				i, tt.desc, want, got)
+		}
+		if want, got := tt.payload[6:10], b[6:10]; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected tag: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServerLogMalformed(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Server{
+		ErrorLog: log.New(&buf, "", 0),
+	}
+
+	// Only the first of a burst of malformed requests is logged
+	for i := 0; i < 10; i++ {
+		s.logMalformed(clientMAC, io.ErrUnexpectedEOF)
+	}
+
+	if want, got := 1, strings.Count(buf.String(), "\n"); want != got {
+		t.Fatalf("unexpected number of log messages: %v != %v", want, got)
+	}
+}
+
+func TestServerResponseSender(t *testing.T) {
+	var tests = []struct {
+		desc string
+		send *Header
+		h    *Header
+	}{
+		{
+			desc: "argument only",
+			send: &Header{
+				Arg: &ConfigArg{
+					BufferCount: 16,
+					Version:     Version,
+					String:      []byte{},
+				},
+			},
+			h: func() *Header {
+				h := testRequest()
+				h.FlagResponse = true
+				h.Arg = &ConfigArg{
+					BufferCount: 16,
+					Version:     Version,
+					String:      []byte{},
+				}
+				return h
+			}(),
+		},
+		{
+			desc: "request fields overwritten",
+			send: &Header{
+				Major:   10,
+				Minor:   20,
+				Command: CommandReserveRelease,
+				Tag:     [4]byte{1, 1, 1, 1},
+			},
+			h: func() *Header {
+				h := testRequest()
+				h.FlagResponse = true
+				return h
+			}(),
+		},
+		{
+			desc: "error, request argument echoed",
+			send: &Header{
+				Error: ErrorBadArgumentParameter,
+			},
+			h: func() *Header {
+				h := testRequest()
+				h.FlagResponse = true
+				h.FlagError = true
+				h.Error = ErrorBadArgumentParameter
+				return h
+			}(),
+		},
+	}
+
+	for i, tt := range tests {
+		send := HandlerFunc(func(w ResponseSender, r *Request) {
+			_, _ = w.Send(tt.send)
+		})
+
+		f, ok := serveOne(t, send, &ethernet.Frame{
+			Destination: ethernet.Broadcast,
+			Source:      clientMAC,
+			EtherType:   EtherType,
+			Payload:     mustMarshal(t, testRequest()),
+		})
+		if !ok {
+			t.Fatalf("[%02d] test %q, no reply from server", i, tt.desc)
+		}
+
+		if want, got := clientMAC, f.Destination; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected destination:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+
+		h := new(Header)
+		if err := h.UnmarshalBinary(f.Payload); err != nil {
+			t.Fatalf("[%02d] test %q, failed to unmarshal reply: %v", i, tt.desc, err)
+		}
+		if want, got := tt.h, h; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Header:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	s := &Server{
+		Iface: &net.Interface{HardwareAddr: serverMAC},
+		Handler: HandlerFunc(func(w ResponseSender, r *Request) {
+			close(started)
+			<-block
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+
+	c, cc := newMemConnPair()
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Serve(c)
+	}()
+
+	if _, err := cc.WriteFrame(mustFrame(t, testRequest())); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+	<-started
+
+	// Handler is blocked, so Shutdown must time out
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if want, got := context.DeadlineExceeded, s.Shutdown(ctx); want != got {
+		t.Fatalf("unexpected Shutdown error: %v != %v", want, got)
+	}
+	if want, got := ErrServerClosed, <-errC; want != got {
+		t.Fatalf("unexpected Serve error: %v != %v", want, got)
+	}
+
+	// Once the handler completes, Shutdown should succeed
+	close(block)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected Shutdown error: %v", err)
+	}
+
+	// New calls to Serve fail immediately
+	c, _ = newMemConnPair()
+	if want, got := ErrServerClosed, s.Serve(c); want != got {
+		t.Fatalf("unexpected Serve error: %v != %v", want, got)
+	}
+}
+
+func Test_trimPadding(t *testing.T) {
+	var tests = []struct {
+		desc string
+		b    []byte
+		n    int
+	}{
+		{
+			desc: "too short",
+			b:    make([]byte, headerLen),
+			n:    headerLen,
+		},
+		{
+			desc: "unknown command",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 0xff}, make([]byte, 40)...),
+			n:    46,
+		},
+		{
+			desc: "ATA argument too short",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0x01}, make([]byte, 10)...),
+			n:    headerLen + ataArgLen - 1,
+		},
+		{
+			desc: "ATA read padding removed",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0x00, 0, 1}, make([]byte, 33)...),
+			n:    headerLen + ataArgLen,
+		},
+		{
+			desc: "ATA write without sectors padding removed",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0x01, 0, 0}, make([]byte, 33)...),
+			n:    headerLen + ataArgLen,
+		},
+		{
+			desc: "ATA write sector count exceeds payload",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0x01, 0, 1}, make([]byte, 33)...),
+			n:    46,
+		},
+		{
+			desc: "ATA response",
+			b:    append([]byte{0x18, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0x00, 0, 1}, make([]byte, 600)...),
+			n:    13 + 600,
+		},
+		{
+			desc: "ATA write padding removed",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 0, 0, 0, 0, 0, 0x01, 0, 1}, make([]byte, 600)...),
+			n:    headerLen + ataArgLen + sectorSize,
+		},
+		{
+			desc: "reserve/release length field exceeds payload",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 3, 0, 0, 0, 0, 0, 10}, make([]byte, 34)...),
+			n:    46,
+		},
+		{
+			desc: "reserve/release padding removed",
+			b:    append([]byte{0x10, 0, 0, 1, 2, 3, 0, 0, 0, 0, 0, 1}, make([]byte, 34)...),
+			n:    headerLen + reserveReleaseArgLen + 6,
+		},
+	}
+
+	for i, tt := range tests {
+		if want, got := tt.n, len(trimPadding(tt.b)); want != got {
+			t.Fatalf("[%02d] test %q, unexpected length: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+// serveOne starts a Server with Handler h, sends frame f to it, and returns
+// the reply frame, if one is sent.
+func serveOne(t *testing.T, h Handler, f *ethernet.Frame) (*ethernet.Frame, bool) {
+	fs := serveFrames(t, testServer(h), f)
+	if len(fs) == 0 {
+		return nil, false
+	}
+	if len(fs) > 1 {
+		t.Fatalf("expected at most one reply, but got %d", len(fs))
+	}
+
+	return fs[0], true
+}
+
+// testServer creates a Server for use in tests with Handler h.
+func testServer(h Handler) *Server {
+	return &Server{
+		Iface:    &net.Interface{HardwareAddr: serverMAC},
+		Handler:  h,
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+}
+
+// serveFrames starts Server s, sends frame f to it, and returns all reply
+// frames sent before s is shut down.
+func serveFrames(t *testing.T, s *Server, f *ethernet.Frame) []*ethernet.Frame {
+	c, cc := newMemConnPair()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = s.Serve(c)
+	}()
+
+	fb, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal frame: %v", err)
+	}
+	if _, err := cc.WriteFrame(fb); err != nil {
+		t.Fatalf("failed to write frame: %v", err)
+	}
+
+	// Once ReadFrame is called for a second time, the request has been
+	// dispatched to a handler.  Shutdown waits for all handlers to complete
+	// before replies are collected.
+	c.waitRead(2)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down server: %v", err)
+	}
+	<-done
+
+	var fs []*ethernet.Frame
+	for _, b := range cc.drain() {
+		rf := new(ethernet.Frame)
+		if err := rf.UnmarshalBinary(b); err != nil {
+			t.Fatalf("failed to unmarshal reply frame: %v", err)
+		}
+		fs = append(fs, rf)
+	}
+
+	return fs
+}
+
+// testRequest returns a basic AoE request Header for use in tests.
+func testRequest() *Header {
+	return &Header{
+		Version: Version,
+		Major:   1,
+		Minor:   2,
+		Command: CommandQueryConfigInformation,
+		Tag:     [4]byte{0xde, 0xad, 0xbe, 0xef},
+		Arg: &ConfigArg{
+			Command: ConfigCommandRead,
+			String:  []byte{},
+		},
+	}
+}
+
+// mustMarshal marshals h to binary, failing the test if an error occurs.
+func mustMarshal(t *testing.T, h *Header) []byte {
+	b, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal header: %v", err)
+	}
+
+	return b
+}
+
+// mustFrame encapsulates h in an Ethernet frame sent from clientMAC to
+// serverMAC, failing the test if an error occurs.
+func mustFrame(t *testing.T, h *Header) []byte {
+	f := &ethernet.Frame{
+		Destination: serverMAC,
+		Source:      clientMAC,
+		EtherType:   EtherType,
+		Payload:     mustMarshal(t, h),
+	}
+
+	b, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal frame: %v", err)
+	}
+
+	return b
+}
+
+var errMemConnClosed = errors.New("memConn closed")
+
+// memConn is an in-memory Conn.  Frames written to one memConn are read
+// from its peer.
+type memConn struct {
+	in  chan []byte
+	out chan []byte
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	reads  int
+	once   sync.Once
+	closed chan struct{}
+}
+
+// newMemConnPair creates a pair of connected memConns.
+func newMemConnPair() (*memConn, *memConn) {
+	a := make(chan []byte, 64)
+	b := make(chan []byte, 64)
+
+	c1 := &memConn{in: a, out: b, closed: make(chan struct{})}
+	c2 := &memConn{in: b, out: a, closed: make(chan struct{})}
+	c1.cond = sync.NewCond(&c1.mu)
+	c2.cond = sync.NewCond(&c2.mu)
+
+	return c1, c2
+}
+
+func (c *memConn) ReadFrame(b []byte) (int, error) {
+	c.mu.Lock()
+	c.reads++
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return 0, errMemConnClosed
+	case f := <-c.in:
+		return copy(b, f), nil
+	}
+}
+
+func (c *memConn) WriteFrame(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errMemConnClosed
+	default:
+	}
+
+	f := make([]byte, len(b))
+	copy(f, b)
+
+	select {
+	case c.out <- f:
+		return len(b), nil
+	case <-c.closed:
+		return 0, errMemConnClosed
+	}
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+// waitRead blocks until ReadFrame has been called at least n times.
+func (c *memConn) waitRead(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.reads < n {
+		c.cond.Wait()
+	}
+}
+
+// drain returns all frames which are waiting to be read from c.
+func (c *memConn) drain() [][]byte {
+	var fs [][]byte
+	for {
+		select {
+		case f := <-c.in:
+			fs = append(fs, f)
+		default:
+			return fs
+		}
+	}
+}
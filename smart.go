@@ -0,0 +1,201 @@
+package aoe
+
+import "encoding/binary"
+
+// SMART subcommands, specified in the Features register of an ATA SMART
+// command, as described in ATA8-ACS, Section 7.52.
+const (
+	smartReadData       = 0xd0
+	smartReadThresholds = 0xd1
+	smartEnable         = 0xd8
+	smartDisable        = 0xd9
+	smartReturnStatus   = 0xda
+)
+
+// Values of the LBA Mid and LBA High registers which must accompany every
+// SMART command, and which are returned by SMART RETURN STATUS when a device
+// is healthy.  A device which has exceeded a threshold returns the
+// smartFail values instead.
+const (
+	smartLBAMid      = 0x4f
+	smartLBAHigh     = 0xc2
+	smartFailLBAMid  = 0xf4
+	smartFailLBAHigh = 0x2c
+)
+
+// A SMARTProvider is an object which can report SMART (Self-Monitoring,
+// Analysis and Reporting Technology) data for a device.  If the store
+// passed to ServeATA or ServeATAAt does not implement SMARTProvider,
+// synthetic data describing a healthy device is reported.
+type SMARTProvider interface {
+	// SMARTData returns the 512 byte SMART data structure reported by
+	// SMART READ DATA, including its checksum.
+	SMARTData() ([512]byte, error)
+
+	// SMARTThresholds returns the 512 byte attribute threshold structure
+	// reported by SMART READ ATTRIBUTE THRESHOLDS, including its checksum.
+	SMARTThresholds() ([512]byte, error)
+
+	// SMARTStatus reports whether the device is healthy, or whether any
+	// attribute has exceeded its threshold.
+	SMARTStatus() (healthy bool, err error)
+}
+
+// smartAttributes are the attributes reported by healthySMART, using the
+// identifiers and flags commonly understood by smartmontools.
+var smartAttributes = []struct {
+	id        uint8
+	flags     uint16
+	threshold uint8
+}{
+	// Reallocated Sectors Count: pre-failure, online
+	{id: 0x05, flags: 0x0033, threshold: 10},
+	// Power-On Hours: online
+	{id: 0x09, flags: 0x0032},
+	// Power Cycle Count: online
+	{id: 0x0c, flags: 0x0032},
+}
+
+// healthySMART is a SMARTProvider which reports synthetic data for a
+// healthy device.  It is used for stores which do not implement
+// SMARTProvider, such as files.
+type healthySMART struct{}
+
+// SMARTData implements SMARTProvider.
+func (healthySMART) SMARTData() ([512]byte, error) {
+	var b [512]byte
+
+	// Data structure revision
+	binary.LittleEndian.PutUint16(b[0:2], 0x0010)
+
+	// Each attribute is at its best possible value, with no raw events
+	for i, a := range smartAttributes {
+		e := b[2+i*12 : 2+(i+1)*12]
+		e[0] = a.id
+		binary.LittleEndian.PutUint16(e[1:3], a.flags)
+		e[3] = 100
+		e[4] = 100
+	}
+
+	// Offline data collection and self-tests are not supported.  SMART data
+	// is saved before entering power saving modes, and automatically after
+	// events.
+	binary.LittleEndian.PutUint16(b[368:370], 0x0003)
+
+	smartChecksum(&b)
+	return b, nil
+}
+
+// SMARTThresholds implements SMARTProvider.
+func (healthySMART) SMARTThresholds() ([512]byte, error) {
+	var b [512]byte
+
+	// Data structure revision
+	binary.LittleEndian.PutUint16(b[0:2], 0x0010)
+
+	for i, a := range smartAttributes {
+		e := b[2+i*12 : 2+(i+1)*12]
+		e[0] = a.id
+		e[1] = a.threshold
+	}
+
+	smartChecksum(&b)
+	return b, nil
+}
+
+// SMARTStatus implements SMARTProvider.
+func (healthySMART) SMARTStatus() (bool, error) {
+	return true, nil
+}
+
+// smartChecksum sets the final byte of a SMART data structure, so that the
+// sum of all bytes in b is zero.
+func smartChecksum(b *[512]byte) {
+	var sum byte
+	for _, c := range b[:511] {
+		sum += c
+	}
+	b[511] = -sum
+}
+
+// ataSMART performs an ATA SMART request on s using the argument values in
+// r.  The SMART subcommand is specified by r.ErrFeature.  SMART may be
+// enabled and disabled by clients for Target t.  If t is nil, SMART is
+// always enabled, and requests to disable it are aborted.
+func ataSMART(r *ATAArg, s *ataStore, t *Target) (*ATAArg, error) {
+	// Only ATA SMART allowed here
+	if r.CmdStatus != ATACmdStatusSMART {
+		return nil, errATAAbort
+	}
+
+	// SMART commands must carry the SMART signature in LBA Mid and High
+	if r.LBA[1] != smartLBAMid || r.LBA[2] != smartLBAHigh {
+		return nil, errATAAbort
+	}
+
+	switch r.ErrFeature {
+	case smartEnable, smartDisable:
+		// Without a Target, SMART cannot be disabled
+		if t == nil && r.ErrFeature == smartDisable {
+			return nil, errATAAbort
+		}
+
+		t.updateATAFeatures(func(f *ataFeatures) {
+			f.smartDisabled = r.ErrFeature == smartDisable
+		})
+
+		return &ATAArg{
+			CmdStatus: ATACmdStatusReadyStatus,
+		}, nil
+	}
+
+	// All other subcommands are aborted while SMART is disabled
+	if t.ataFeatures().smartDisabled {
+		return nil, errATAAbort
+	}
+
+	sp, ok := s.v.(SMARTProvider)
+	if !ok {
+		sp = healthySMART{}
+	}
+
+	switch r.ErrFeature {
+	case smartReadData, smartReadThresholds:
+		// Request must be for 1 sector (512 bytes)
+		if r.SectorCount != 1 {
+			return nil, errATAAbort
+		}
+
+		read := sp.SMARTData
+		if r.ErrFeature == smartReadThresholds {
+			read = sp.SMARTThresholds
+		}
+
+		b, err := read()
+		if err != nil {
+			return nil, errATAAbort
+		}
+
+		return &ATAArg{
+			CmdStatus: ATACmdStatusReadyStatus,
+			Data:      b[:],
+		}, nil
+	case smartReturnStatus:
+		healthy, err := sp.SMARTStatus()
+		if err != nil {
+			return nil, errATAAbort
+		}
+
+		lba := [6]uint8{1: smartLBAMid, 2: smartLBAHigh}
+		if !healthy {
+			lba = [6]uint8{1: smartFailLBAMid, 2: smartFailLBAHigh}
+		}
+
+		return &ATAArg{
+			CmdStatus: ATACmdStatusReadyStatus,
+			LBA:       lba,
+		}, nil
+	default:
+		return nil, errATAAbort
+	}
+}
@@ -0,0 +1,301 @@
+package aoe
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func Test_ataSMART(t *testing.T) {
+	// Error returned by errSMART for error handling tests
+	errFoo := errors.New("foo")
+
+	// SMART signature which must accompany each SMART command
+	sig := [6]uint8{1: smartLBAMid, 2: smartLBAHigh}
+
+	data, _ := healthySMART{}.SMARTData()
+	thresholds, _ := healthySMART{}.SMARTThresholds()
+
+	var tests = []struct {
+		desc string
+		rarg *ATAArg
+		rs   io.ReadSeeker
+		t    *Target
+		warg *ATAArg
+		err  error
+	}{
+		{
+			desc: "non-ATA SMART command",
+			rarg: &ATAArg{
+				CmdStatus: ATACmdStatusIdentify,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "missing SMART signature",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadData,
+				SectorCount: 1,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "unknown subcommand",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSMART,
+				ErrFeature: 0xd4,
+				LBA:        sig,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "read data wrong sector count",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadData,
+				SectorCount: 2,
+				LBA:         sig,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "read data synthetic",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadData,
+				SectorCount: 1,
+				LBA:         sig,
+			},
+			rs: &noopReadWriteSeeker{},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				Data:      data[:],
+			},
+		},
+		{
+			desc: "read thresholds synthetic",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadThresholds,
+				SectorCount: 1,
+				LBA:         sig,
+			},
+			rs: &noopReadWriteSeeker{},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				Data:      thresholds[:],
+			},
+		},
+		{
+			desc: "read data error",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadData,
+				SectorCount: 1,
+				LBA:         sig,
+			},
+			rs:  &errSMART{err: errFoo},
+			err: errATAAbort,
+		},
+		{
+			desc: "read data SMARTProvider",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadData,
+				SectorCount: 1,
+				LBA:         sig,
+			},
+			rs: &errSMART{},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				Data:      make([]byte, 512),
+			},
+		},
+		{
+			desc: "return status healthy",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSMART,
+				ErrFeature: smartReturnStatus,
+				LBA:        sig,
+			},
+			rs: &noopReadWriteSeeker{},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				LBA:       sig,
+			},
+		},
+		{
+			desc: "return status threshold exceeded",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSMART,
+				ErrFeature: smartReturnStatus,
+				LBA:        sig,
+			},
+			rs: &errSMART{failing: true},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+				LBA:       [6]uint8{1: smartFailLBAMid, 2: smartFailLBAHigh},
+			},
+		},
+		{
+			desc: "return status error",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSMART,
+				ErrFeature: smartReturnStatus,
+				LBA:        sig,
+			},
+			rs:  &errSMART{err: errFoo},
+			err: errATAAbort,
+		},
+		{
+			desc: "enable without Target",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSMART,
+				ErrFeature: smartEnable,
+				LBA:        sig,
+			},
+			warg: &ATAArg{
+				CmdStatus: ATACmdStatusReadyStatus,
+			},
+		},
+		{
+			desc: "disable without Target",
+			rarg: &ATAArg{
+				CmdStatus:  ATACmdStatusSMART,
+				ErrFeature: smartDisable,
+				LBA:        sig,
+			},
+			err: errATAAbort,
+		},
+		{
+			desc: "read data while disabled",
+			rarg: &ATAArg{
+				CmdStatus:   ATACmdStatusSMART,
+				ErrFeature:  smartReadData,
+				SectorCount: 1,
+				LBA:         sig,
+			},
+			rs: &noopReadWriteSeeker{},
+			t: &Target{
+				features: ataFeatures{smartDisabled: true},
+			},
+			err: errATAAbort,
+		},
+	}
+
+	for i, tt := range tests {
+		warg, err := ataSMART(tt.rarg, newATAStore(tt.rs), tt.t)
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.warg, warg; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected ATAArg:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_ataSMARTEnableDisable(t *testing.T) {
+	target := &Target{}
+	s := newATAStore(&noopReadWriteSeeker{})
+
+	smart := func(feature uint8) error {
+		_, err := ataSMART(&ATAArg{
+			CmdStatus:  ATACmdStatusSMART,
+			ErrFeature: feature,
+			LBA:        [6]uint8{1: smartLBAMid, 2: smartLBAHigh},
+		}, s, target)
+		return err
+	}
+
+	var tests = []struct {
+		desc     string
+		feature  uint8
+		err      error
+		disabled bool
+	}{
+		{
+			desc:    "status while enabled",
+			feature: smartReturnStatus,
+		},
+		{
+			desc:     "disable",
+			feature:  smartDisable,
+			disabled: true,
+		},
+		{
+			desc:     "status while disabled",
+			feature:  smartReturnStatus,
+			err:      errATAAbort,
+			disabled: true,
+		},
+		{
+			desc:    "enable",
+			feature: smartEnable,
+		},
+		{
+			desc:    "status after enable",
+			feature: smartReturnStatus,
+		},
+	}
+
+	for i, tt := range tests {
+		if want, got := tt.err, smart(tt.feature); want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.desc, want, got)
+		}
+
+		if want, got := tt.disabled, target.ataFeatures().smartDisabled; want != got {
+			t.Fatalf("[%02d] test %q, unexpected SMART disabled state: %v != %v",
+				i, tt.desc, want, got)
+		}
+
+		// IDENTIFY reports whether SMART is enabled in word 85
+		id := identify(0, nil, target.ataFeatures(), false)
+		if want, got := !tt.disabled, id[85*2]&0x01 != 0; want != got {
+			t.Fatalf("[%02d] test %q, unexpected SMART enabled bit: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_healthySMARTChecksum(t *testing.T) {
+	data, err := healthySMART{}.SMARTData()
+	if err != nil {
+		t.Fatalf("failed to read SMART data: %v", err)
+	}
+	thresholds, err := healthySMART{}.SMARTThresholds()
+	if err != nil {
+		t.Fatalf("failed to read SMART thresholds: %v", err)
+	}
+
+	for _, b := range [][512]byte{data, thresholds} {
+		var sum byte
+		for _, c := range b {
+			sum += c
+		}
+		if sum != 0 {
+			t.Fatalf("invalid checksum: %#02x", sum)
+		}
+	}
+}
+
+// errSMART is a SMARTProvider which returns empty data, reports whether
+// its failing field is set, and returns its err field.
+type errSMART struct {
+	noopReadWriteSeeker
+	failing bool
+	err     error
+}
+
+func (s *errSMART) SMARTData() ([512]byte, error)       { return [512]byte{}, s.err }
+func (s *errSMART) SMARTThresholds() ([512]byte, error) { return [512]byte{}, s.err }
+func (s *errSMART) SMARTStatus() (bool, error)          { return !s.failing, s.err }
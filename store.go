@@ -0,0 +1,205 @@
+package aoe
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// errUnknownSize is returned when the capacity of a store cannot be
+// determined.
+var errUnknownSize = errors.New("cannot determine size of store")
+
+// An ataStore is the backing store used to serve ATA commands.  Reads and
+// writes are performed using ReadAt and WriteAt, so that stores which
+// implement io.ReaderAt and io.WriterAt, such as *os.File, can serve
+// concurrent requests without locking.  Stores which only implement
+// io.ReadSeeker are adapted using Seek and Read or Write, serialized by a
+// mutex.
+//
+// Optional interfaces, such as Syncer and Identifier, are checked using the
+// original store value.
+type ataStore struct {
+	v  interface{}
+	ra io.ReaderAt
+	wa io.WriterAt
+
+	// mu serializes the use of Seek on v.
+	mu sync.Mutex
+
+	// rmw serializes writes which read and modify partial physical sectors
+	// with all other writes, when no Target is associated with a request.
+	rmw sync.RWMutex
+}
+
+// newATAStore creates an ataStore from v, which must implement io.ReaderAt,
+// io.ReadSeeker, or both.  If v implements neither io.WriterAt nor
+// io.Writer, writes are not supported.
+func newATAStore(v interface{}) *ataStore {
+	s := &ataStore{v: v}
+
+	if ra, ok := v.(io.ReaderAt); ok {
+		s.ra = ra
+	} else if rs, ok := v.(io.ReadSeeker); ok {
+		s.ra = &seekReaderAt{s: s, rs: rs}
+	}
+
+	if wa, ok := v.(io.WriterAt); ok {
+		s.wa = wa
+	} else if ws, ok := v.(io.WriteSeeker); ok {
+		s.wa = &seekWriterAt{s: s, ws: ws}
+	}
+
+	return s
+}
+
+// size determines the size of the store in bytes, using its Size method if
+// it implements Sizer or a similar interface, its Stat method if it has
+// one, or by seeking to its end otherwise.  If the store is seeked, its
+// original offset is restored.
+func (s *ataStore) size() (int64, error) {
+	if size, ok, err := statSize(s.v); ok {
+		return size, err
+	}
+
+	sk, ok := s.v.(io.Seeker)
+	if !ok {
+		return 0, errUnknownSize
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, err := sk.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return 0, err
+	}
+	end, err := sk.Seek(0, os.SEEK_END)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := sk.Seek(cur, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+
+	return end, nil
+}
+
+// sync commits the store's written data to stable storage, if the store
+// implements Syncer.  Otherwise, its writes are already as durable as they
+// can be made.
+func (s *ataStore) sync() error {
+	sy, ok := s.v.(Syncer)
+	if !ok {
+		return nil
+	}
+
+	return sy.Sync()
+}
+
+// statSize determines the size of v in bytes without seeking, using its
+// Size method if it implements Sizer or a similar interface, or its Stat
+// method if it has one.  If the size cannot be determined in this way, ok is
+// false.
+func statSize(v interface{}) (size int64, ok bool, err error) {
+	switch v := v.(type) {
+	case Sizer:
+		size, err := v.Size()
+		return size, true, err
+	case interface {
+		Size() int64
+	}:
+		// *bytes.Reader, *io.SectionReader, etc.
+		return v.Size(), true, nil
+	case interface {
+		Stat() (os.FileInfo, error)
+	}:
+		// Stat reports a zero size for block devices, so fall back to
+		// seeking for them
+		fi, err := v.Stat()
+		if err != nil {
+			return 0, true, err
+		}
+		if fi.Mode().IsRegular() {
+			return fi.Size(), true, nil
+		}
+	}
+
+	return 0, false, nil
+}
+
+// A seekReaderAt adapts an io.ReadSeeker into an io.ReaderAt.
+type seekReaderAt struct {
+	s  *ataStore
+	rs io.ReadSeeker
+}
+
+func (r *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, err := r.rs.Seek(off, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+
+	return r.rs.Read(p)
+}
+
+// A seekWriterAt adapts an io.WriteSeeker into an io.WriterAt.
+type seekWriterAt struct {
+	s  *ataStore
+	ws io.WriteSeeker
+}
+
+func (w *seekWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+
+	if _, err := w.ws.Seek(off, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+
+	return w.ws.Write(p)
+}
+
+// readFullAt reads exactly len(p) bytes from the store at offset off, in
+// the same manner as io.ReadFull.  If fewer than len(p) bytes are read, an
+// error is returned; io.EOF indicates that the end of the store was reached.
+func (s *ataStore) readFullAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		nn, err := s.ra.ReadAt(p[n:], off+int64(n))
+		n += nn
+		switch {
+		case n >= len(p):
+			return len(p), nil
+		case err == io.ErrUnexpectedEOF:
+			return n, io.EOF
+		case err != nil:
+			return n, err
+		case nn == 0:
+			return n, io.ErrNoProgress
+		}
+	}
+
+	return n, nil
+}
+
+// writeFullAt writes all of p to the store at offset off, retrying short
+// writes.  If fewer than len(p) bytes are written, an error is returned.
+func (s *ataStore) writeFullAt(p []byte, off int64) (int, error) {
+	var n int
+	for n < len(p) {
+		nn, err := s.wa.WriteAt(p[n:], off+int64(n))
+		n += nn
+		switch {
+		case err != nil:
+			return n, err
+		case nn == 0:
+			return n, io.ErrShortWrite
+		}
+	}
+
+	return n, nil
+}
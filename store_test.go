@@ -0,0 +1,229 @@
+package aoe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func Test_ataStoreSize(t *testing.T) {
+	f, err := ioutil.TempFile("", "aoe")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, 2048)); err != nil {
+		t.Fatalf("failed to write temporary file: %v", err)
+	}
+
+	var tests = []struct {
+		desc string
+		v    interface{}
+		size int64
+		err  error
+	}{
+		{
+			desc: "Sizer",
+			v:    &sizer{size: 4096},
+			size: 4096,
+		},
+		{
+			desc: "Size method without error",
+			v:    bytes.NewReader(make([]byte, 1024)),
+			size: 1024,
+		},
+		{
+			desc: "Stat method",
+			v:    f,
+			size: 2048,
+		},
+		{
+			desc: "io.Seeker",
+			v:    newMemStore(512),
+			size: 512,
+		},
+		{
+			desc: "unknown size",
+			v:    &readerAt{},
+			err:  errUnknownSize,
+		},
+	}
+
+	for i, tt := range tests {
+		size, err := newATAStore(tt.v).size()
+		if err != nil || tt.err != nil {
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+					i, tt.desc, want, got)
+			}
+
+			continue
+		}
+
+		if want, got := tt.size, size; want != got {
+			t.Fatalf("[%02d] test %q, unexpected size: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_ataStoreSizeRestoresOffset(t *testing.T) {
+	ms := newMemStore(1024)
+	if _, err := ms.Seek(10, os.SEEK_SET); err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+
+	if _, err := newATAStore(ms).size(); err != nil {
+		t.Fatalf("failed to determine size: %v", err)
+	}
+
+	off, err := ms.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		t.Fatalf("failed to seek: %v", err)
+	}
+	if want, got := int64(10), off; want != got {
+		t.Fatalf("unexpected offset: %v != %v", want, got)
+	}
+}
+
+func TestServeATAConcurrent(t *testing.T) {
+	// Each sector of the store is filled with its own LBA
+	b := make([]byte, 64*sectorSize)
+	for i := range b {
+		b[i] = byte(i / sectorSize)
+	}
+
+	var tests = []struct {
+		desc string
+		h    Handler
+	}{
+		{
+			desc: "io.ReaderAt",
+			h:    ATAHandlerAt(bytes.NewReader(b)),
+		},
+		{
+			desc: "io.ReadSeeker adapter",
+			h:    ATAHandler(&readSeeker{r: bytes.NewReader(b)}),
+		},
+	}
+
+	for i, tt := range tests {
+		var wg sync.WaitGroup
+		badC := make(chan int, 64)
+
+		for lba := 0; lba < 64; lba++ {
+			wg.Add(1)
+			go func(lba int) {
+				defer wg.Done()
+
+				w := &captureHeaderResponseSender{h: &Header{}}
+				tt.h.ServeAoE(w, &Request{Header: &Header{
+					Command: CommandIssueATACommand,
+					Arg: &ATAArg{
+						CmdStatus:   ATACmdStatusRead28Bit,
+						LBA:         [6]uint8{uint8(lba)},
+						SectorCount: 1,
+					},
+				}})
+
+				arg := w.h.Arg.(*ATAArg)
+				if !bytes.Equal(bytes.Repeat([]byte{byte(lba)}, sectorSize), arg.Data) {
+					badC <- lba
+				}
+			}(lba)
+		}
+
+		wg.Wait()
+		close(badC)
+
+		if lba, ok := <-badC; ok {
+			t.Fatalf("[%02d] test %q, unexpected data read for LBA %d",
+				i, tt.desc, lba)
+		}
+	}
+}
+
+func TestServeATAAtWrite(t *testing.T) {
+	f, err := ioutil.TempFile("", "aoe")
+	if err != nil {
+		t.Fatalf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	b := bytes.Repeat([]byte{1}, sectorSize)
+
+	w := &captureHeaderResponseSender{h: &Header{}}
+	_, err = ServeATAAt(w, &Request{Header: &Header{
+		Command: CommandIssueATACommand,
+		Arg: &ATAArg{
+			FlagWrite:   true,
+			CmdStatus:   ATACmdStatusWrite48Bit,
+			LBA:         [6]uint8{1},
+			SectorCount: 1,
+			Data:        b,
+		},
+	}}, f)
+	if err != nil {
+		t.Fatalf("failed to serve ATA: %v", err)
+	}
+
+	got := make([]byte, sectorSize)
+	if _, err := f.ReadAt(got, sectorSize); err != nil {
+		t.Fatalf("failed to read temporary file: %v", err)
+	}
+	if !bytes.Equal(b, got) {
+		t.Fatal("unexpected data written to file")
+	}
+
+	// Read-only io.ReaderAt cannot be written
+	_, err = ServeATAAt(w, &Request{Header: &Header{
+		Command: CommandIssueATACommand,
+		Arg: &ATAArg{
+			FlagWrite:   true,
+			CmdStatus:   ATACmdStatusWrite48Bit,
+			SectorCount: 1,
+			Data:        b,
+		},
+	}}, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("failed to serve ATA: %v", err)
+	}
+	if want, got := uint8(ATAErrAbort), w.h.Arg.(*ATAArg).ErrFeature; want != got {
+		t.Fatalf("unexpected ATA error: %v != %v", want, got)
+	}
+}
+
+// readerAt is an io.ReaderAt with no other methods.
+type readerAt struct{}
+
+func (readerAt) ReadAt(p []byte, off int64) (int, error) { return 0, nil }
+
+// readSeeker is an io.ReadSeeker which hides any other methods of r, and
+// which is not safe for concurrent use.
+type readSeeker struct {
+	r   *bytes.Reader
+	off int64
+}
+
+func (rs *readSeeker) Read(p []byte) (int, error) {
+	n, err := rs.r.ReadAt(p, rs.off)
+	rs.off += int64(n)
+	return n, err
+}
+
+func (rs *readSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case os.SEEK_CUR:
+		offset += rs.off
+	case os.SEEK_END:
+		offset += rs.r.Size()
+	}
+
+	rs.off = offset
+	return offset, nil
+}
@@ -0,0 +1,334 @@
+package aoe
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrTargetExists is returned when a Target is added to a
+	// TargetRegistry, but a Target with the same Major and Minor address
+	// is already present.
+	ErrTargetExists = errors.New("target already exists")
+
+	// ErrInvalidTargetAddress is returned when a Target with a broadcast
+	// Major or Minor address is added to a TargetRegistry.
+	ErrInvalidTargetAddress = errors.New("invalid target address")
+)
+
+// A Target is an ATA over Ethernet target, such as a single exported block
+// device or file.  A Target is addressed by its Major (shelf) and Minor (slot)
+// address.
+//
+// A Target's config string, MAC mask list, and reserve list may be modified
+// by clients using AoE commands, and are safe for concurrent use.
+type Target struct {
+	// Major and Minor specify the address of the Target.  Neither may be
+	// set to the broadcast values BroadcastMajor or BroadcastMinor.
+	Major uint16
+	Minor uint8
+
+	// Store specifies the backing store used to serve ATA commands issued
+	// to the Target.  If Store implements io.ReaderAt and io.WriterAt, such
+	// as *os.File, concurrent ATA commands are served in parallel.
+	// Otherwise, ATA commands are serialized.  Store must not be modified
+	// after the Target is added to a TargetRegistry.
+	Store io.ReadSeeker
+
+	// BufferCount specifies the maximum number of outstanding messages the
+	// Target can queue for processing, reported to clients in ConfigArg
+	// replies.
+	BufferCount uint16
+
+	// FirmwareVersion specifies the firmware version reported to clients in
+	// ConfigArg replies.
+	FirmwareVersion uint16
+
+	// SectorCount specifies the maximum number of sectors the Target can
+	// handle in a single ATA command request, reported to clients in
+	// ConfigArg replies.  A value of 0 is equivalent to 2.
+	SectorCount uint8
+
+	// Size, if not zero, specifies the fixed capacity of the Target in
+	// bytes.  ATA reads and writes beyond Size are rejected, and Size is
+	// reported as the capacity of the device when identification data is
+	// generated.  Any partial sector at the end of the Target cannot be
+	// addressed.
+	//
+	// If zero, the capacity of the Target is the current size of Store, and
+	// ATA writes beyond the end of Store grow it.
+	Size int64
+
+	// Identity, if not nil, specifies the ATA device identification data
+	// reported to clients when Store does not implement Identifier.
+	Identity *Identity
+
+	storeOnce sync.Once
+	store     *ataStore
+
+	// rmw serializes writes to Store which read and modify partial
+	// physical sectors with all other writes.  It is kept by the Target,
+	// rather than its ataStore, so that it is shared by concurrent calls
+	// to ServeATA and ServeATAAt, which each create their own ataStore.
+	rmw sync.RWMutex
+
+	mu       sync.RWMutex
+	config   []byte
+	macMask  []net.HardwareAddr
+	reserve  []net.HardwareAddr
+	features ataFeatures
+}
+
+// ataFeatures returns the state of the Target's ATA device features.  If t
+// is nil, the default state is returned.
+func (t *Target) ataFeatures() ataFeatures {
+	if t == nil {
+		return ataFeatures{}
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.features
+}
+
+// updateATAFeatures calls fn to modify the state of the Target's ATA device
+// features.  If t is nil, the state cannot be changed, and fn is not
+// called.
+func (t *Target) updateATAFeatures(fn func(f *ataFeatures)) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fn(&t.features)
+}
+
+// ataStore returns the ataStore used to serve ATA commands using the
+// Target's Store.  The ataStore is created on first use and shared by all
+// requests, so that Stores which do not implement io.ReaderAt and
+// io.WriterAt are used safely.
+func (t *Target) ataStore() *ataStore {
+	t.storeOnce.Do(func() {
+		t.store = newATAStore(t.Store)
+	})
+
+	return t.store
+}
+
+// Config returns a copy of the Target's config string.
+func (t *Target) Config() []byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return copyBytes(t.config)
+}
+
+// SetConfig sets the Target's config string.
+//
+// If b is longer than 1024 bytes, ErrorBadArgumentParameter is returned.
+func (t *Target) SetConfig(b []byte) error {
+	// Config strings may not be longer than 1024 bytes, per AoEr11,
+	// Section 3.2.
+	if len(b) > 1024 {
+		return ErrorBadArgumentParameter
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.config = copyBytes(b)
+	return nil
+}
+
+// setConfigIfEmpty sets the Target's config string to b, if and only if the
+// config string is currently empty.  It reports whether the config string
+// was set.
+func (t *Target) setConfigIfEmpty(b []byte) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.config) > 0 {
+		return false
+	}
+
+	t.config = copyBytes(b)
+	return true
+}
+
+// MACMask returns a copy of the Target's MAC mask list.
+func (t *Target) MACMask() []net.HardwareAddr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return copyMACs(t.macMask)
+}
+
+// SetMACMask replaces the Target's MAC mask list.
+func (t *Target) SetMACMask(macs []net.HardwareAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.macMask = copyMACs(macs)
+}
+
+// Reserve returns a copy of the Target's reserve list.
+func (t *Target) Reserve() []net.HardwareAddr {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return copyMACs(t.reserve)
+}
+
+// SetReserve replaces the Target's reserve list.
+func (t *Target) SetReserve(macs []net.HardwareAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.reserve = copyMACs(macs)
+}
+
+// matches reports whether the Target is addressed by the Major and Minor
+// values in h, including broadcast values.
+func (t *Target) matches(h *Header) bool {
+	if h.Major != BroadcastMajor && h.Major != t.Major {
+		return false
+	}
+
+	return h.Minor == BroadcastMinor || h.Minor == t.Minor
+}
+
+// A TargetRegistry is a set of Targets served by a Server.  A TargetRegistry
+// is safe for concurrent use, and Targets may be added or removed while a
+// Server is running.
+type TargetRegistry struct {
+	mu      sync.RWMutex
+	targets map[targetAddr]*Target
+}
+
+// targetAddr is the Major and Minor address of a Target.
+type targetAddr struct {
+	major uint16
+	minor uint8
+}
+
+// NewTargetRegistry creates a new, empty TargetRegistry.
+func NewTargetRegistry() *TargetRegistry {
+	return &TargetRegistry{
+		targets: make(map[targetAddr]*Target),
+	}
+}
+
+// Add adds Target t to the TargetRegistry.
+//
+// If t uses a broadcast Major or Minor address, ErrInvalidTargetAddress is
+// returned.  If t's Identity is invalid, ErrInvalidIdentity is returned.  If
+// a Target with the same address already exists, ErrTargetExists is
+// returned.
+func (tr *TargetRegistry) Add(t *Target) error {
+	if t.Major == BroadcastMajor || t.Minor == BroadcastMinor {
+		return ErrInvalidTargetAddress
+	}
+	if t.Identity != nil && !t.Identity.validate() {
+		return ErrInvalidIdentity
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if tr.targets == nil {
+		tr.targets = make(map[targetAddr]*Target)
+	}
+
+	addr := targetAddr{major: t.Major, minor: t.Minor}
+	if _, ok := tr.targets[addr]; ok {
+		return ErrTargetExists
+	}
+	tr.targets[addr] = t
+
+	return nil
+}
+
+// Remove removes the Target with the specified Major and Minor address from
+// the TargetRegistry.  Remove reports whether a Target was removed.
+func (tr *TargetRegistry) Remove(major uint16, minor uint8) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	addr := targetAddr{major: major, minor: minor}
+	if _, ok := tr.targets[addr]; !ok {
+		return false
+	}
+	delete(tr.targets, addr)
+
+	return true
+}
+
+// Lookup returns all Targets addressed by the Major and Minor values in h,
+// ordered by Major and then Minor address.  BroadcastMajor and BroadcastMinor
+// match any Target.
+//
+// If no Targets match, Lookup returns nil.
+func (tr *TargetRegistry) Lookup(h *Header) []*Target {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+
+	// Fast path: unicast address
+	if h.Major != BroadcastMajor && h.Minor != BroadcastMinor {
+		t, ok := tr.targets[targetAddr{major: h.Major, minor: h.Minor}]
+		if !ok {
+			return nil
+		}
+
+		return []*Target{t}
+	}
+
+	var ts []*Target
+	for _, t := range tr.targets {
+		if t.matches(h) {
+			ts = append(ts, t)
+		}
+	}
+
+	sort.Sort(byAddress(ts))
+	return ts
+}
+
+// byAddress sorts Targets by Major and then Minor address.
+type byAddress []*Target
+
+func (b byAddress) Len() int      { return len(b) }
+func (b byAddress) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byAddress) Less(i, j int) bool {
+	if b[i].Major != b[j].Major {
+		return b[i].Major < b[j].Major
+	}
+
+	return b[i].Minor < b[j].Minor
+}
+
+// copyBytes returns a copy of b.
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
+
+// copyMACs returns a deep copy of macs.
+func copyMACs(macs []net.HardwareAddr) []net.HardwareAddr {
+	if len(macs) == 0 {
+		return nil
+	}
+
+	c := make([]net.HardwareAddr, 0, len(macs))
+	for _, m := range macs {
+		c = append(c, net.HardwareAddr(copyBytes(m)))
+	}
+
+	return c
+}
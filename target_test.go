@@ -0,0 +1,222 @@
+package aoe
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mdlayher/ethernet"
+)
+
+func TestTargetRegistryAdd(t *testing.T) {
+	var tests = []struct {
+		desc string
+		t    *Target
+		err  error
+	}{
+		{
+			desc: "broadcast major",
+			t:    &Target{Major: BroadcastMajor},
+			err:  ErrInvalidTargetAddress,
+		},
+		{
+			desc: "broadcast minor",
+			t:    &Target{Minor: BroadcastMinor},
+			err:  ErrInvalidTargetAddress,
+		},
+		{
+			desc: "duplicate address",
+			t:    &Target{Major: 1, Minor: 1},
+			err:  ErrTargetExists,
+		},
+		{
+			desc: "OK",
+			t:    &Target{Major: 1, Minor: 2},
+		},
+	}
+
+	for i, tt := range tests {
+		tr := NewTargetRegistry()
+		if err := tr.Add(&Target{Major: 1, Minor: 1}); err != nil {
+			t.Fatalf("[%02d] test %q, failed to add target: %v", i, tt.desc, err)
+		}
+
+		if want, got := tt.err, tr.Add(tt.t); want != got {
+			t.Fatalf("[%02d] test %q, unexpected error: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func TestTargetRegistryLookup(t *testing.T) {
+	tr := new(TargetRegistry)
+	ts := []*Target{
+		{Major: 2, Minor: 1},
+		{Major: 1, Minor: 2},
+		{Major: 1, Minor: 1},
+	}
+	for _, target := range ts {
+		if err := tr.Add(target); err != nil {
+			t.Fatalf("failed to add target: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		desc  string
+		major uint16
+		minor uint8
+		ts    []*Target
+	}{
+		{
+			desc:  "unknown address",
+			major: 3,
+			minor: 1,
+		},
+		{
+			desc:  "unicast",
+			major: 1,
+			minor: 2,
+			ts:    []*Target{ts[1]},
+		},
+		{
+			desc:  "broadcast minor",
+			major: 1,
+			minor: BroadcastMinor,
+			ts:    []*Target{ts[2], ts[1]},
+		},
+		{
+			desc:  "broadcast major",
+			major: BroadcastMajor,
+			minor: 1,
+			ts:    []*Target{ts[2], ts[0]},
+		},
+		{
+			desc:  "broadcast major and minor",
+			major: BroadcastMajor,
+			minor: BroadcastMinor,
+			ts:    []*Target{ts[2], ts[1], ts[0]},
+		},
+	}
+
+	for i, tt := range tests {
+		got := tr.Lookup(&Header{Major: tt.major, Minor: tt.minor})
+		if want := tt.ts; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected Targets:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+
+	if !tr.Remove(1, 2) {
+		t.Fatal("failed to remove target")
+	}
+	if tr.Remove(1, 2) {
+		t.Fatal("removed target twice")
+	}
+	if got := tr.Lookup(&Header{Major: 1, Minor: 2}); got != nil {
+		t.Fatalf("removed target still present: %v", got)
+	}
+}
+
+func TestTargetCopies(t *testing.T) {
+	target := new(Target)
+
+	config := []byte("foo")
+	if err := target.SetConfig(config); err != nil {
+		t.Fatalf("failed to set config: %v", err)
+	}
+	config[0] = 'b'
+	if want, got := []byte("foo"), target.Config(); !bytes.Equal(want, got) {
+		t.Fatalf("unexpected config string:\n- want: %v\n-  got: %v", want, got)
+	}
+
+	if want, got := ErrorBadArgumentParameter, target.SetConfig(make([]byte, 1025)); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	macs := []net.HardwareAddr{{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}}
+	target.SetMACMask(macs)
+	target.SetReserve(macs)
+	macs[0][0] = 0
+
+	want := []net.HardwareAddr{{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad}}
+	if got := target.MACMask(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected MAC mask list:\n- want: %v\n-  got: %v", want, got)
+	}
+	if got := target.Reserve(); !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected reserve list:\n- want: %v\n-  got: %v", want, got)
+	}
+}
+
+func TestServerTargets(t *testing.T) {
+	var tests = []struct {
+		desc  string
+		major uint16
+		minor uint8
+		addrs [][2]int
+	}{
+		{
+			desc:  "unknown address ignored",
+			major: 2,
+			minor: 2,
+		},
+		{
+			desc:  "unicast",
+			major: 1,
+			minor: 2,
+			addrs: [][2]int{{1, 2}},
+		},
+		{
+			desc:  "broadcast",
+			major: BroadcastMajor,
+			minor: BroadcastMinor,
+			addrs: [][2]int{{1, 1}, {1, 2}, {2, 1}},
+		},
+	}
+
+	for i, tt := range tests {
+		s := testServer(HandlerFunc(func(w ResponseSender, r *Request) {
+			// Reply only if a Target is associated with this request
+			if r.Target == nil {
+				return
+			}
+
+			_, _ = w.Send(&Header{})
+		}))
+		s.Targets = NewTargetRegistry()
+		for _, addr := range [][2]int{{1, 1}, {1, 2}, {2, 1}} {
+			if err := s.Targets.Add(&Target{
+				Major: uint16(addr[0]),
+				Minor: uint8(addr[1]),
+			}); err != nil {
+				t.Fatalf("[%02d] test %q, failed to add target: %v", i, tt.desc, err)
+			}
+		}
+
+		h := testRequest()
+		h.Major = tt.major
+		h.Minor = tt.minor
+
+		fs := serveFrames(t, s, &ethernet.Frame{
+			Destination: ethernet.Broadcast,
+			Source:      clientMAC,
+			EtherType:   EtherType,
+			Payload:     mustMarshal(t, h),
+		})
+
+		var addrs [][2]int
+		for _, f := range fs {
+			rh := new(Header)
+			if err := rh.UnmarshalBinary(f.Payload); err != nil {
+				t.Fatalf("[%02d] test %q, failed to unmarshal reply: %v", i, tt.desc, err)
+			}
+
+			addrs = append(addrs, [2]int{int(rh.Major), int(rh.Minor)})
+		}
+
+		if want, got := tt.addrs, addrs; !reflect.DeepEqual(want, got) {
+			t.Fatalf("[%02d] test %q, unexpected reply addresses:\n- want: %v\n-  got: %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package aoe
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// initialRTO is the retransmission timeout used before any round trip
+	// time samples have been collected for a target.
+	initialRTO = 100 * time.Millisecond
+
+	// minRTO and maxRTO bound the retransmission timeout for a target.
+	minRTO = 5 * time.Millisecond
+	maxRTO = 5 * time.Second
+)
+
+// A window tracks the smoothed round trip time and the outstanding request
+// window for a single AoE target, in the same manner as the Linux AoE
+// driver.
+//
+// The window size begins at one request, grows by one request after a full
+// window of requests is answered without loss, and is halved whenever a
+// request must be retransmitted.  The window size never exceeds the
+// target's advertised buffer count.
+type window struct {
+	mu sync.Mutex
+
+	// Round trip time estimates, as described in RFC 6298.
+	srtt   time.Duration
+	rttvar time.Duration
+
+	// size is the current window size, and max is the target's advertised
+	// buffer count.  acks counts successful requests since the window last
+	// grew.
+	size int
+	max  int
+	acks int
+
+	// outstanding is the number of requests currently in flight.  changed
+	// is closed and replaced whenever a slot in the window is released.
+	outstanding int
+	changed     chan struct{}
+}
+
+// newWindow creates a window for a target which advertises a buffer count
+// of max.
+func newWindow(max int) *window {
+	if max < 1 {
+		max = 1
+	}
+
+	return &window{
+		size:    1,
+		max:     max,
+		changed: make(chan struct{}),
+	}
+}
+
+// setMax updates the target's advertised buffer count.
+func (w *window) setMax(max int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if max < 1 {
+		max = 1
+	}
+	w.max = max
+	if w.size > w.max {
+		w.size = w.max
+	}
+}
+
+// acquire blocks until a request may be sent within the window, or until
+// ctx is canceled.
+func (w *window) acquire(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		if w.outstanding < w.size {
+			w.outstanding++
+			w.mu.Unlock()
+			return nil
+		}
+		changed := w.changed
+		w.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot acquired by acquire.
+func (w *window) release() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.outstanding--
+	w.signal()
+}
+
+// rto returns the current retransmission timeout.
+func (w *window) rto() time.Duration {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.srtt == 0 {
+		return initialRTO
+	}
+
+	return clampRTO(w.srtt + 4*w.rttvar)
+}
+
+// success records a request which was answered without retransmission,
+// and which took rtt to complete.
+func (w *window) success(rtt time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.srtt == 0 {
+		w.srtt = rtt
+		w.rttvar = rtt / 2
+	} else {
+		// RFC 6298: alpha = 1/8, beta = 1/4
+		delta := w.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		w.rttvar += (delta - w.rttvar) / 4
+		w.srtt += (rtt - w.srtt) / 8
+	}
+
+	// Additive increase, after a full window of successful requests
+	w.acks++
+	if w.acks >= w.size && w.size < w.max {
+		w.size++
+		w.acks = 0
+	}
+
+	w.signal()
+}
+
+// loss records a request which must be retransmitted.
+func (w *window) loss() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Multiplicative decrease
+	w.size /= 2
+	if w.size < 1 {
+		w.size = 1
+	}
+	w.acks = 0
+}
+
+// signal wakes any goroutines blocked in acquire.  The caller must hold
+// w.mu.
+func (w *window) signal() {
+	close(w.changed)
+	w.changed = make(chan struct{})
+}
+
+// clampRTO bounds d between minRTO and maxRTO.
+func clampRTO(d time.Duration) time.Duration {
+	if d < minRTO {
+		return minRTO
+	}
+	if d > maxRTO {
+		return maxRTO
+	}
+
+	return d
+}
@@ -0,0 +1,112 @@
+package aoe
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_windowRTO(t *testing.T) {
+	var tests = []struct {
+		desc    string
+		samples []time.Duration
+		rto     time.Duration
+	}{
+		{
+			desc: "no samples",
+			rto:  initialRTO,
+		},
+		{
+			desc:    "one sample",
+			samples: []time.Duration{10 * time.Millisecond},
+			// srtt + 4 * (srtt / 2)
+			rto: 30 * time.Millisecond,
+		},
+		{
+			desc:    "steady samples",
+			samples: []time.Duration{10 * time.Millisecond, 10 * time.Millisecond},
+			// rttvar: 5ms + (0 - 5ms) / 4
+			rto: 10*time.Millisecond + 4*(5*time.Millisecond-5*time.Millisecond/4),
+		},
+		{
+			desc:    "clamped to minimum",
+			samples: []time.Duration{time.Microsecond},
+			rto:     minRTO,
+		},
+		{
+			desc:    "clamped to maximum",
+			samples: []time.Duration{time.Minute},
+			rto:     maxRTO,
+		},
+	}
+
+	for i, tt := range tests {
+		w := newWindow(1)
+		for _, s := range tt.samples {
+			w.success(s)
+		}
+
+		if want, got := tt.rto, w.rto(); want != got {
+			t.Fatalf("[%02d] test %q, unexpected RTO: %v != %v",
+				i, tt.desc, want, got)
+		}
+	}
+}
+
+func Test_windowSize(t *testing.T) {
+	w := newWindow(4)
+	if want, got := 1, w.size; want != got {
+		t.Fatalf("unexpected initial window size: %v != %v", want, got)
+	}
+
+	// 1 + 2 + 3 acks are required to grow to 4, and further acks must not
+	// exceed the buffer count
+	for i := 0; i < 10; i++ {
+		w.success(time.Millisecond)
+	}
+	if want, got := 4, w.size; want != got {
+		t.Fatalf("unexpected window size after success: %v != %v", want, got)
+	}
+
+	w.loss()
+	if want, got := 2, w.size; want != got {
+		t.Fatalf("unexpected window size after loss: %v != %v", want, got)
+	}
+
+	w.loss()
+	w.loss()
+	if want, got := 1, w.size; want != got {
+		t.Fatalf("unexpected minimum window size: %v != %v", want, got)
+	}
+
+	w.setMax(0)
+	if want, got := 1, w.max; want != got {
+		t.Fatalf("unexpected maximum window size: %v != %v", want, got)
+	}
+}
+
+func Test_windowAcquire(t *testing.T) {
+	w := newWindow(2)
+	if err := w.acquire(context.Background()); err != nil {
+		t.Fatalf("failed to acquire: %v", err)
+	}
+
+	// Window is full, so acquire blocks until canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if want, got := context.DeadlineExceeded, w.acquire(ctx); want != got {
+		t.Fatalf("unexpected error: %v != %v", want, got)
+	}
+
+	// Releasing a slot unblocks a waiting acquire
+	errC := make(chan error, 1)
+	go func() {
+		errC <- w.acquire(context.Background())
+	}()
+
+	w.release()
+	if err := <-errC; err != nil {
+		t.Fatalf("failed to acquire after release: %v", err)
+	}
+}
@@ -0,0 +1,379 @@
+package aoe
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrWriteBackClosed is returned by WriteBack methods after a call to
+// WriteBack.Close.
+var ErrWriteBackClosed = errors.New("write-back queue closed")
+
+// writeBackAlign is the alignment, in bytes, of the buffers used to hold
+// queued writes.  It is a multiple of the logical sector size of common
+// devices, and of the memory alignment required by O_DIRECT on Linux.
+const writeBackAlign = 4096
+
+var (
+	// Compile-time interface checks
+	_ io.ReadWriteSeeker = &WriteBack{}
+	_ io.ReaderAt        = &WriteBack{}
+	_ io.WriterAt        = &WriteBack{}
+	_ AsyncWriterAt      = &WriteBack{}
+	_ Syncer             = &WriteBack{}
+	_ Sizer              = &WriteBack{}
+)
+
+// An AsyncWriterAt is an object which can queue writes to be applied in the
+// background.  If the store passed to ServeATA or ServeATAAt implements
+// AsyncWriterAt, ATA writes with FlagAsynchronous set are queued using
+// WriteAtAsync, and acknowledged immediately.
+//
+// WriteAtAsync must not retain p.  Writes queued using WriteAtAsync must be
+// visible to subsequent reads, and must be applied before any subsequent
+// call to Sync returns.
+type AsyncWriterAt interface {
+	WriteAtAsync(p []byte, off int64) error
+}
+
+// A WriteBack is an io.ReadWriteSeeker which applies asynchronous writes to
+// an underlying io.ReadWriteSeeker using a background goroutine.
+// WriteBack implements AsyncWriterAt, io.ReaderAt, io.WriterAt, and Sizer,
+// and can be used as a Target's Store to honor ATA writes with
+// FlagAsynchronous set.
+//
+// Queued writes are applied in the order they were queued.  Reads and
+// synchronous writes which overlap a queued write wait until it is applied,
+// so clients always observe their own writes.
+//
+// A WriteBack is safe for concurrent use.
+type WriteBack struct {
+	rws io.ReadWriteSeeker
+	max int
+
+	// ioMu serializes Seek-based access to rws.
+	ioMu sync.Mutex
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	off    int64
+	queue  []*queuedWrite
+	queued int
+	err    error
+	closed bool
+
+	done chan struct{}
+}
+
+// A queuedWrite is a write queued by WriteAtAsync.
+type queuedWrite struct {
+	b   []byte
+	off int64
+}
+
+// NewWriteBack creates a WriteBack which applies writes to rws.  Up to
+// maxBytes of data may be queued; once the limit is reached, WriteAtAsync
+// blocks until queued writes are applied.
+//
+// NewWriteBack starts a goroutine which applies queued writes.  Call Close
+// to apply all queued writes and stop the goroutine.
+func NewWriteBack(rws io.ReadWriteSeeker, maxBytes int) *WriteBack {
+	wb := &WriteBack{
+		rws:  rws,
+		max:  maxBytes,
+		done: make(chan struct{}),
+	}
+	wb.cond = sync.NewCond(&wb.mu)
+
+	go wb.writeLoop()
+	return wb
+}
+
+// Read implements io.Reader.  Read waits for any queued writes which
+// overlap the range being read.
+func (wb *WriteBack) Read(p []byte) (int, error) {
+	off := wb.offset()
+	n, err := wb.ReadAt(p, off)
+	wb.advance(off, n)
+	return n, err
+}
+
+// Write implements io.Writer.  Write waits for any queued writes which
+// overlap the range being written, so that writes are applied in order.
+func (wb *WriteBack) Write(p []byte) (int, error) {
+	off := wb.offset()
+	n, err := wb.WriteAt(p, off)
+	wb.advance(off, n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.  ReadAt waits for any queued writes which
+// overlap the range being read.
+func (wb *WriteBack) ReadAt(p []byte, off int64) (int, error) {
+	wb.wait(off, int64(len(p)))
+	return wb.readWriteAt(p, off, false)
+}
+
+// WriteAt implements io.WriterAt.  WriteAt waits for any queued writes which
+// overlap the range being written, so that writes are applied in order.
+func (wb *WriteBack) WriteAt(p []byte, off int64) (int, error) {
+	wb.wait(off, int64(len(p)))
+	return wb.readWriteAt(p, off, true)
+}
+
+// Seek implements io.Seeker.  Seeking relative to the end of the WriteBack
+// uses the size reported by Size, and does not wait for queued writes.
+func (wb *WriteBack) Seek(offset int64, whence int) (int64, error) {
+	var end int64
+	if whence == os.SEEK_END {
+		var err error
+		if end, err = wb.Size(); err != nil {
+			return 0, err
+		}
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	switch whence {
+	case os.SEEK_SET:
+	case os.SEEK_CUR:
+		offset += wb.off
+	case os.SEEK_END:
+		offset += end
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	wb.off = offset
+	return offset, nil
+}
+
+// Size implements Sizer.  Size does not wait for queued writes to be
+// applied.  Instead, it reports the larger of the size of the underlying
+// io.ReadWriteSeeker and the end of the last queued write, which is the size
+// the underlying io.ReadWriteSeeker will have once all queued writes are
+// applied.
+func (wb *WriteBack) Size() (int64, error) {
+	// Determine the end of queued writes first, so that a write applied
+	// while the underlying size is determined is not missed
+	wb.mu.Lock()
+	var end int64
+	for _, q := range wb.queue {
+		if qend := q.off + int64(len(q.b)); qend > end {
+			end = qend
+		}
+	}
+	wb.mu.Unlock()
+
+	size, ok, err := statSize(wb.rws)
+	if !ok {
+		wb.ioMu.Lock()
+		size, err = wb.rws.Seek(0, os.SEEK_END)
+		wb.ioMu.Unlock()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if end > size {
+		return end, nil
+	}
+
+	return size, nil
+}
+
+// WriteAtAsync implements AsyncWriterAt.  WriteAtAsync copies p and queues
+// it to be written at offset off.  If the queue is full, WriteAtAsync blocks
+// until enough queued writes are applied.
+//
+// The copy of p is aligned to writeBackAlign bytes, so that writes prepared
+// by ServeATA remain aligned when applied to a file opened with O_DIRECT.
+//
+// If a previously queued write failed, its error is returned, and p is not
+// queued.  If the WriteBack is closed, ErrWriteBackClosed is returned.
+func (wb *WriteBack) WriteAtAsync(p []byte, off int64) error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// Always allow at least one write to be queued, so that writes larger
+	// than the limit can make progress
+	for !wb.closed && wb.err == nil && wb.queued > 0 && wb.queued+len(p) > wb.max {
+		wb.cond.Wait()
+	}
+
+	if wb.closed {
+		return ErrWriteBackClosed
+	}
+	if wb.err != nil {
+		return wb.err
+	}
+
+	b := alignedBuffer(len(p), writeBackAlign)
+	copy(b, p)
+
+	wb.queue = append(wb.queue, &queuedWrite{
+		b:   b,
+		off: off,
+	})
+	wb.queued += len(b)
+	wb.cond.Broadcast()
+
+	return nil
+}
+
+// Flush waits for all queued writes to be applied.  If any queued write
+// failed, the first error is returned, and cleared.
+func (wb *WriteBack) Flush() error {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	for len(wb.queue) > 0 {
+		wb.cond.Wait()
+	}
+
+	err := wb.err
+	wb.err = nil
+	return err
+}
+
+// Sync implements Syncer.  Sync applies all queued writes using Flush, and
+// then commits them to stable storage if the underlying io.ReadWriteSeeker
+// implements Syncer.
+func (wb *WriteBack) Sync() error {
+	if err := wb.Flush(); err != nil {
+		return err
+	}
+
+	s, ok := wb.rws.(Syncer)
+	if !ok {
+		return nil
+	}
+
+	wb.ioMu.Lock()
+	defer wb.ioMu.Unlock()
+
+	return s.Sync()
+}
+
+// Close applies all queued writes, and stops the WriteBack's goroutine.
+// Close does not close the underlying io.ReadWriteSeeker.  If any queued
+// write failed, the first error is returned.
+func (wb *WriteBack) Close() error {
+	wb.mu.Lock()
+	if wb.closed {
+		wb.mu.Unlock()
+		return ErrWriteBackClosed
+	}
+	wb.closed = true
+	wb.cond.Broadcast()
+	wb.mu.Unlock()
+
+	<-wb.done
+	return wb.Flush()
+}
+
+// offset returns the current offset.
+func (wb *WriteBack) offset() int64 {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	return wb.off
+}
+
+// wait waits until no queued write overlaps the n bytes beginning at off.
+func (wb *WriteBack) wait(off int64, n int64) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	for wb.overlaps(off, n) {
+		wb.cond.Wait()
+	}
+}
+
+// overlaps reports whether any queued write overlaps the n bytes beginning
+// at off.  The caller must hold wb.mu.
+func (wb *WriteBack) overlaps(off int64, n int64) bool {
+	for _, q := range wb.queue {
+		if off < q.off+int64(len(q.b)) && q.off < off+n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// advance sets the current offset after n bytes were transferred at off.
+func (wb *WriteBack) advance(off int64, n int) {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	wb.off = off + int64(n)
+}
+
+// readWriteAt reads or writes p at offset off in the underlying
+// io.ReadWriteSeeker.  If the underlying io.ReadWriteSeeker implements
+// io.ReaderAt or io.WriterAt, it is used without locking.
+func (wb *WriteBack) readWriteAt(p []byte, off int64, write bool) (int, error) {
+	if ra, ok := wb.rws.(io.ReaderAt); ok && !write {
+		return ra.ReadAt(p, off)
+	}
+	if wa, ok := wb.rws.(io.WriterAt); ok && write {
+		return wa.WriteAt(p, off)
+	}
+
+	wb.ioMu.Lock()
+	defer wb.ioMu.Unlock()
+
+	if _, err := wb.rws.Seek(off, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+
+	if write {
+		return wb.rws.Write(p)
+	}
+
+	return wb.rws.Read(p)
+}
+
+// writeLoop applies queued writes in order, until the WriteBack is closed
+// and its queue is empty.
+func (wb *WriteBack) writeLoop() {
+	defer close(wb.done)
+
+	for {
+		wb.mu.Lock()
+		for len(wb.queue) == 0 && !wb.closed {
+			wb.cond.Wait()
+		}
+		if len(wb.queue) == 0 {
+			wb.mu.Unlock()
+			return
+		}
+
+		// Leave the write in the queue until it is applied, so overlapping
+		// reads and writes continue to wait for it
+		q := wb.queue[0]
+		wb.mu.Unlock()
+
+		n, err := wb.readWriteAt(q.b, q.off, true)
+		if err == nil && n != len(q.b) {
+			err = io.ErrShortWrite
+		}
+
+		wb.mu.Lock()
+		wb.queue = wb.queue[1:]
+		wb.queued -= len(q.b)
+		if err != nil && wb.err == nil {
+			wb.err = err
+		}
+		wb.cond.Broadcast()
+		wb.mu.Unlock()
+	}
+}
@@ -0,0 +1,505 @@
+package aoe
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestWriteBackReadYourWrites(t *testing.T) {
+	// Hold all writes to the underlying store until released
+	ms := newMemStore(4 * sectorSize)
+	ms.hold()
+
+	wb := NewWriteBack(ms, 4*sectorSize)
+	defer wb.Close()
+
+	// Two writes to the same sector are applied in order
+	if err := wb.WriteAtAsync(bytes.Repeat([]byte{1}, sectorSize), 0); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+	if err := wb.WriteAtAsync(bytes.Repeat([]byte{2}, sectorSize), 0); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+
+	readC := make(chan []byte, 1)
+	go func() {
+		b := make([]byte, sectorSize)
+		_, _ = wb.Seek(0, os.SEEK_SET)
+		_, _ = io.ReadFull(wb, b)
+		readC <- b
+	}()
+
+	// Read must wait for the overlapping writes
+	select {
+	case <-readC:
+		t.Fatal("read did not wait for queued writes")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	ms.release()
+
+	if want, got := bytes.Repeat([]byte{2}, sectorSize), <-readC; !bytes.Equal(want, got) {
+		t.Fatal("unexpected data read after queued writes")
+	}
+}
+
+func TestWriteBackBounded(t *testing.T) {
+	ms := newMemStore(4 * sectorSize)
+	ms.hold()
+
+	wb := NewWriteBack(ms, 2*sectorSize)
+	defer wb.Close()
+
+	// The first write is always queued, but the second exceeds the limit
+	if err := wb.WriteAtAsync(make([]byte, 2*sectorSize), 0); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- wb.WriteAtAsync(make([]byte, sectorSize), 2*sectorSize)
+	}()
+
+	select {
+	case <-errC:
+		t.Fatal("write was queued beyond limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	ms.release()
+	if err := <-errC; err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+}
+
+func TestWriteBackErrors(t *testing.T) {
+	errFoo := errors.New("foo")
+
+	wb := NewWriteBack(&errWriter{err: errFoo}, sectorSize)
+
+	if err := wb.WriteAtAsync(make([]byte, sectorSize), 0); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+
+	// Error from the background write is reported by Flush, and cleared
+	if want, got := errFoo, wb.Flush(); want != got {
+		t.Fatalf("unexpected Flush error: %v != %v", want, got)
+	}
+	if err := wb.Flush(); err != nil {
+		t.Fatalf("unexpected second Flush error: %v", err)
+	}
+
+	if err := wb.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if want, got := ErrWriteBackClosed, wb.WriteAtAsync(nil, 0); want != got {
+		t.Fatalf("unexpected error after close: %v != %v", want, got)
+	}
+}
+
+func TestWriteBackSync(t *testing.T) {
+	ms := newMemStore(sectorSize)
+	wb := NewWriteBack(ms, sectorSize)
+	defer wb.Close()
+
+	b := bytes.Repeat([]byte{1}, sectorSize)
+	if err := wb.WriteAtAsync(b, 0); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+	if err := wb.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+
+	if want, got := b, ms.bytes(); !bytes.Equal(want, got) {
+		t.Fatal("queued write not applied by Sync")
+	}
+	if want, got := 1, ms.syncs(); want != got {
+		t.Fatalf("unexpected number of syncs: %v != %v", want, got)
+	}
+}
+
+func TestServeATAAsynchronousWrite(t *testing.T) {
+	ms := newMemStore(2 * sectorSize)
+	ms.hold()
+	defer ms.release()
+
+	wb := NewWriteBack(ms, 2*sectorSize)
+
+	// Write is acknowledged before it is applied
+	w := &captureHeaderResponseSender{h: &Header{}}
+	_, err := ServeATA(w, &Request{Header: &Header{
+		Command: CommandIssueATACommand,
+		Arg: &ATAArg{
+			FlagWrite:        true,
+			FlagAsynchronous: true,
+			CmdStatus:        ATACmdStatusWrite28Bit,
+			SectorCount:      1,
+			Data:             bytes.Repeat([]byte{1}, sectorSize),
+		},
+	}}, wb)
+	if err != nil {
+		t.Fatalf("failed to serve ATA: %v", err)
+	}
+
+	want := &ATAArg{CmdStatus: ATACmdStatusReadyStatus}
+	if got := w.h.Arg.(*ATAArg); !reflect.DeepEqual(want, got) {
+		t.Fatalf("unexpected ATAArg: %v != %v", want, got)
+	}
+	if want, got := make([]byte, 2*sectorSize), ms.bytes(); !bytes.Equal(want, got) {
+		t.Fatal("asynchronous write applied before acknowledgement")
+	}
+}
+
+func TestWriteBackSize(t *testing.T) {
+	ms := newMemStore(2 * sectorSize)
+	ms.hold()
+
+	wb := NewWriteBack(memStoreAt{ms}, 4*sectorSize)
+	defer wb.Close()
+
+	// Release held writes before closing the WriteBack
+	defer ms.release()
+
+	size := func() int64 {
+		n, err := wb.Size()
+		if err != nil {
+			t.Fatalf("failed to determine size: %v", err)
+		}
+		return n
+	}
+
+	if want, got := int64(2*sectorSize), size(); want != got {
+		t.Fatalf("unexpected size: %v != %v", want, got)
+	}
+
+	// Size includes a held write beyond the end of the store, without
+	// waiting for it to be applied
+	if err := wb.WriteAtAsync(make([]byte, sectorSize), 3*sectorSize); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+	if want, got := int64(4*sectorSize), size(); want != got {
+		t.Fatalf("unexpected size with queued write: %v != %v", want, got)
+	}
+}
+
+func TestServeATAReadDoesNotWaitForQueuedWrite(t *testing.T) {
+	ms := newMemStore(2048 * sectorSize)
+	ms.hold()
+
+	wb := NewWriteBack(memStoreAt{ms}, 4*sectorSize)
+	defer wb.Close()
+
+	// Release held writes before closing the WriteBack
+	defer ms.release()
+
+	// The target's capacity is determined using the WriteBack's size
+	target := &Target{Major: 1, Minor: 1, Store: wb}
+
+	if err := wb.WriteAtAsync(make([]byte, sectorSize), 1024*sectorSize); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+
+	argC := make(chan *ATAArg, 1)
+	go func() {
+		w := &captureHeaderResponseSender{}
+		_, _ = serveATA(w, &Request{
+			Header: &Header{
+				Command: CommandIssueATACommand,
+				Arg: &ATAArg{
+					CmdStatus:   ATACmdStatusRead28Bit,
+					SectorCount: 1,
+				},
+			},
+			Target: target,
+		}, target.ataStore())
+		argC <- w.h.Arg.(*ATAArg)
+	}()
+
+	// A read which does not overlap the held write completes immediately
+	select {
+	case arg := <-argC:
+		if want, got := ATACmdStatusReadyStatus, arg.CmdStatus; want != got {
+			t.Fatalf("unexpected read status: %#02x != %#02x", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read waited for unrelated queued write")
+	}
+}
+
+func TestWriteBackAlignedBuffers(t *testing.T) {
+	ms := newMemStore(8 * sectorSize)
+	ms.hold()
+
+	wb := NewWriteBack(ms, 8*sectorSize)
+	defer wb.Close()
+
+	// Release held writes before closing the WriteBack
+	defer ms.release()
+
+	for i := 0; i < 8; i++ {
+		if err := wb.WriteAtAsync(make([]byte, sectorSize), int64(i*sectorSize)); err != nil {
+			t.Fatalf("failed to queue write: %v", err)
+		}
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+
+	// Every queued copy is aligned, regardless of its length
+	for i, w := range wb.queue {
+		if addr := uintptr(unsafe.Pointer(&w.b[0])); addr%writeBackAlign != 0 {
+			t.Fatalf("[%02d] queued write buffer not aligned: %#x", i, addr)
+		}
+	}
+}
+
+func TestServeATAAsynchronousWriteAligned(t *testing.T) {
+	const physical = 4096
+
+	// The underlying store rejects I/O with unaligned buffers
+	ds := &directStore{
+		align: physical,
+		b:     make([]byte, physical*2),
+	}
+
+	wb := NewWriteBack(ds, physical*2)
+	defer wb.Close()
+
+	target := &Target{
+		Major:    1,
+		Minor:    1,
+		Store:    wb,
+		Identity: &Identity{PhysicalSectorSize: physical},
+	}
+
+	// Write one AoE sector within the second physical sector
+	data := bytes.Repeat([]byte{1}, sectorSize)
+
+	w := &captureHeaderResponseSender{}
+	_, err := serveATA(w, &Request{
+		Header: &Header{
+			Command: CommandIssueATACommand,
+			Arg: &ATAArg{
+				FlagWrite:        true,
+				FlagAsynchronous: true,
+				CmdStatus:        ATACmdStatusWrite28Bit,
+				LBA:              [6]uint8{9},
+				SectorCount:      1,
+				Data:             data,
+			},
+		},
+		Target: target,
+	}, target.ataStore())
+	if err != nil {
+		t.Fatalf("failed to serve ATA: %v", err)
+	}
+
+	if want, got := ATACmdStatusReadyStatus, w.h.Arg.(*ATAArg).CmdStatus; want != got {
+		t.Fatalf("unexpected write status: %#02x != %#02x", want, got)
+	}
+
+	// The queued write is applied to the store without error
+	if err := wb.Flush(); err != nil {
+		t.Fatalf("failed to apply queued write: %v", err)
+	}
+
+	want := make([]byte, physical*2)
+	copy(want[9*sectorSize:], data)
+	if got := ds.bytes(); !bytes.Equal(want, got) {
+		t.Fatal("unexpected store contents after asynchronous write")
+	}
+}
+
+func TestServerShutdownFlushesWriteBack(t *testing.T) {
+	ms := newMemStore(sectorSize)
+	ms.hold()
+
+	wb := NewWriteBack(ms, sectorSize)
+	defer wb.Close()
+
+	s := testServer(nil)
+	s.Targets = NewTargetRegistry()
+	if err := s.Targets.Add(&Target{Major: 1, Minor: 1, Store: wb}); err != nil {
+		t.Fatalf("failed to add target: %v", err)
+	}
+
+	b := bytes.Repeat([]byte{1}, sectorSize)
+	if err := wb.WriteAtAsync(b, 0); err != nil {
+		t.Fatalf("failed to queue write: %v", err)
+	}
+
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case <-errC:
+		t.Fatal("shutdown did not wait for queued writes")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	ms.release()
+	if err := <-errC; err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	if want, got := b, ms.bytes(); !bytes.Equal(want, got) {
+		t.Fatal("queued write not applied by shutdown")
+	}
+}
+
+// memStore is an in-memory io.ReadWriteSeeker and Syncer, which is safe for
+// concurrent use.  Writes may be held until released.
+type memStore struct {
+	mu   sync.Mutex
+	b    []byte
+	off  int64
+	n    int
+	gate chan struct{}
+}
+
+// newMemStore creates a memStore of n bytes.
+func newMemStore(n int) *memStore {
+	return &memStore{b: make([]byte, n)}
+}
+
+func (s *memStore) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.off >= int64(len(s.b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.b[s.off:])
+	s.off += int64(n)
+	return n, nil
+}
+
+func (s *memStore) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	gate := s.gate
+	s.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if end := s.off + int64(len(p)); end > int64(len(s.b)) {
+		s.b = append(s.b, make([]byte, end-int64(len(s.b)))...)
+	}
+
+	n := copy(s.b[s.off:], p)
+	s.off += int64(n)
+	return n, nil
+}
+
+func (s *memStore) Seek(offset int64, whence int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch whence {
+	case os.SEEK_CUR:
+		offset += s.off
+	case os.SEEK_END:
+		offset += int64(len(s.b))
+	}
+
+	s.off = offset
+	return offset, nil
+}
+
+func (s *memStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.n++
+	return nil
+}
+
+// memStoreAt is a memStore which also implements io.ReaderAt and
+// io.WriterAt, so that a WriteBack does not seek it.
+type memStoreAt struct {
+	*memStore
+}
+
+func (s memStoreAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off >= int64(len(s.b)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (s memStoreAt) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	gate := s.gate
+	s.mu.Unlock()
+
+	if gate != nil {
+		<-gate
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(s.b)) {
+		s.b = append(s.b, make([]byte, end-int64(len(s.b)))...)
+	}
+
+	return copy(s.b[off:], p), nil
+}
+
+// hold causes writes to block until release is called.
+func (s *memStore) hold() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.gate = make(chan struct{})
+}
+
+// release unblocks all held writes.
+func (s *memStore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.gate != nil {
+		close(s.gate)
+		s.gate = nil
+	}
+}
+
+// bytes returns a copy of the contents of s.
+func (s *memStore) bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return copyBytes(s.b)
+}
+
+// syncs returns the number of times Sync was called.
+func (s *memStore) syncs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.n
+}